@@ -0,0 +1,124 @@
+// Copyright 2014-2015 The Dename Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package proto
+
+import (
+	"fmt"
+	"io"
+)
+
+// EntryUpdateProposal is what the keyserver actually proposes to the
+// replicated log for an UpdateProfile call: the SignedEntryUpdate in its
+// preserve-encoding wrapper, plus the external account binding presented
+// alongside it, if any. It is its own wire type -- not a field bolted onto
+// SignedEntryUpdate_PreserveEncoding -- because that type's Marshal/Size
+// are deliberately byte-identical to PreservedEncoding alone, so that
+// embedding it in a parent message re-serializes canonically; adding a
+// field there would make every such embedding emit non-canonical bytes.
+type EntryUpdateProposal struct {
+	Update SignedEntryUpdate_PreserveEncoding
+	Eab    *ExternalAccountBinding
+}
+
+func (m *EntryUpdateProposal) Reset() { *m = EntryUpdateProposal{} }
+
+func (m *EntryUpdateProposal) Size() (n int) {
+	l := m.Update.Size()
+	n += 1 + l + sovExternalAccountBinding(uint64(l))
+	if m.Eab != nil {
+		l := m.Eab.Size()
+		n += 1 + l + sovExternalAccountBinding(uint64(l))
+	}
+	return n
+}
+
+func (m *EntryUpdateProposal) Marshal() ([]byte, error) {
+	size := m.Size()
+	data := make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *EntryUpdateProposal) MarshalTo(data []byte) (int, error) {
+	updateData, err := m.Update.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	data[0] = 0xa
+	i := 1
+	i = encodeVarintExternalAccountBinding(data, i, uint64(len(updateData)))
+	i += copy(data[i:], updateData)
+
+	if m.Eab != nil {
+		eabData, err := m.Eab.Marshal()
+		if err != nil {
+			return 0, err
+		}
+		data[i] = 0x12
+		i++
+		i = encodeVarintExternalAccountBinding(data, i, uint64(len(eabData)))
+		i += copy(data[i:], eabData)
+	}
+	return i, nil
+}
+
+// Unmarshal decodes field 1 (Update, required) and field 2 (Eab, optional).
+func (m *EntryUpdateProposal) Unmarshal(data []byte) error {
+	*m = EntryUpdateProposal{}
+	i := 0
+	sawUpdate := false
+	for i < len(data) {
+		tag, n, err := decodeVarintExternalAccountBinding(data, i)
+		if err != nil {
+			return err
+		}
+		i += n
+		fieldNum := tag >> 3
+		if tag&0x7 != 2 {
+			return fmt.Errorf("proto: EntryUpdateProposal: field %d: unsupported wire type", fieldNum)
+		}
+		l, n, err := decodeVarintExternalAccountBinding(data, i)
+		if err != nil {
+			return err
+		}
+		i += n
+		end := i + int(l)
+		if end < i || end > len(data) {
+			return io.ErrUnexpectedEOF
+		}
+		switch fieldNum {
+		case 1:
+			if err := m.Update.Unmarshal(data[i:end]); err != nil {
+				return err
+			}
+			sawUpdate = true
+		case 2:
+			m.Eab = &ExternalAccountBinding{}
+			if err := m.Eab.Unmarshal(data[i:end]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("proto: EntryUpdateProposal: unknown field %d", fieldNum)
+		}
+		i = end
+	}
+	if !sawUpdate {
+		return fmt.Errorf("proto: EntryUpdateProposal: missing required field Update")
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2014-2015 The Dename Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package proto
+
+import (
+	"fmt"
+	"io"
+)
+
+// ExternalAccountBinding carries an ACME-style EAB credential: Kid names the
+// HMAC key a backing IdP/enterprise admin endpoint previously issued, and Mac
+// is computed over the account's public key with that key. A keyserver that
+// requires EAB attaches this alongside the first SignedEntryUpdate for a
+// username.
+type ExternalAccountBinding struct {
+	Kid string
+	Mac []byte
+}
+
+func (m *ExternalAccountBinding) Reset() {
+	*m = ExternalAccountBinding{}
+}
+
+func (m *ExternalAccountBinding) Size() (n int) {
+	if l := len(m.Kid); l > 0 {
+		n += 1 + l + sovExternalAccountBinding(uint64(l))
+	}
+	if l := len(m.Mac); l > 0 {
+		n += 1 + l + sovExternalAccountBinding(uint64(l))
+	}
+	return n
+}
+
+func sovExternalAccountBinding(x uint64) (n int) {
+	for {
+		n++
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	return n
+}
+
+func encodeVarintExternalAccountBinding(data []byte, offset int, v uint64) int {
+	for v >= 1<<7 {
+		data[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	data[offset] = uint8(v)
+	return offset + 1
+}
+
+// decodeVarintExternalAccountBinding reads the varint at data[offset:],
+// returning its value and how many bytes it occupied.
+func decodeVarintExternalAccountBinding(data []byte, offset int) (v uint64, n int, err error) {
+	shift := uint(0)
+	for {
+		if offset+n >= len(data) {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		b := data[offset+n]
+		n++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, n, nil
+		}
+		shift += 7
+		if shift >= 64 {
+			return 0, 0, fmt.Errorf("proto: ExternalAccountBinding: varint overflow")
+		}
+	}
+}
+
+func (m *ExternalAccountBinding) Marshal() ([]byte, error) {
+	size := m.Size()
+	data := make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *ExternalAccountBinding) MarshalTo(data []byte) (int, error) {
+	i := 0
+	if len(m.Kid) > 0 {
+		data[i] = 0xa
+		i++
+		i = encodeVarintExternalAccountBinding(data, i, uint64(len(m.Kid)))
+		i += copy(data[i:], m.Kid)
+	}
+	if len(m.Mac) > 0 {
+		data[i] = 0x12
+		i++
+		i = encodeVarintExternalAccountBinding(data, i, uint64(len(m.Mac)))
+		i += copy(data[i:], m.Mac)
+	}
+	return i, nil
+}
+
+// Unmarshal decodes a standalone, length-delimited ExternalAccountBinding:
+// field 1 (Kid, wire type 2) and field 2 (Mac, wire type 2), either of which
+// may be omitted when empty.
+func (m *ExternalAccountBinding) Unmarshal(data []byte) error {
+	*m = ExternalAccountBinding{}
+	i := 0
+	for i < len(data) {
+		tag, n, err := decodeVarintExternalAccountBinding(data, i)
+		if err != nil {
+			return err
+		}
+		i += n
+		fieldNum := tag >> 3
+		wireType := tag & 0x7
+		if wireType != 2 {
+			return fmt.Errorf("proto: ExternalAccountBinding: field %d: unsupported wire type %d", fieldNum, wireType)
+		}
+		l, n, err := decodeVarintExternalAccountBinding(data, i)
+		if err != nil {
+			return err
+		}
+		i += n
+		end := i + int(l)
+		if end < i || end > len(data) {
+			return io.ErrUnexpectedEOF
+		}
+		switch fieldNum {
+		case 1:
+			m.Kid = string(data[i:end])
+		case 2:
+			m.Mac = append([]byte{}, data[i:end]...)
+		default:
+			return fmt.Errorf("proto: ExternalAccountBinding: unknown field %d", fieldNum)
+		}
+		i = end
+	}
+	return nil
+}
+
+func (this *ExternalAccountBinding) Equal(that interface{}) bool {
+	thatP, ok := that.(*ExternalAccountBinding)
+	if !ok {
+		return false
+	}
+	if thatP == nil {
+		return this == nil
+	}
+	return this.Kid == thatP.Kid && string(this.Mac) == string(thatP.Mac)
+}
+
+func (this *ExternalAccountBinding) String() string {
+	if this == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("proto.ExternalAccountBinding{Kid: %q, Mac: %#v}", this.Kid, this.Mac)
+}
@@ -91,4 +91,4 @@ func (this *SignedEntryUpdate_PreserveEncoding) String() string {
 		return "nil"
 	}
 	return `proto.SignedEntryUpdate_PreserveEncoding{SignedEntryUpdate: ` + this.SignedEntryUpdate.String() + `, PreservedEncoding: ` + fmt.Sprintf("%v", this.PreservedEncoding) + `}`
-}
\ No newline at end of file
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a standard token-bucket rate limiter: tokens accrue at
+// rate per second up to capacity, and Allow consumes one if available.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity, rate float64) *tokenBucket {
+	return &tokenBucket{tokens: capacity, capacity: capacity, rate: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// updateRateLimiter rate-limits UpdateProfile per identity, keyed by the
+// VRF output of the username rather than the username itself: since the VRF
+// output is pseudorandom and keyed by the keyserver's private VRF key, a set
+// of colluding names can't predict each other's keys well enough to pool
+// their quota into a single bucket, and legitimate lookups of one name never
+// collide with another's bucket.
+type updateRateLimiter struct {
+	mu             sync.Mutex
+	buckets        map[string]*tokenBucket
+	capacity, rate float64
+}
+
+func newUpdateRateLimiter(capacity, ratePerSecond float64) *updateRateLimiter {
+	return &updateRateLimiter{buckets: make(map[string]*tokenBucket), capacity: capacity, rate: ratePerSecond}
+}
+
+func (rl *updateRateLimiter) Allow(vrfOutput []byte) bool {
+	key := string(vrfOutput)
+	rl.mu.Lock()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = newTokenBucket(rl.capacity, rl.rate)
+		rl.buckets[key] = b
+	}
+	rl.mu.Unlock()
+	return b.Allow()
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/yahoo/coname/proto"
+)
+
+// RegistrationPolicy gates which public keys may claim a username on their
+// first SignedEntryUpdate. It lets a keyserver operator enforce an
+// out-of-band authorization scheme (an enterprise directory, an ACME-style
+// external account) without teaching coname itself about that scheme.
+type RegistrationPolicy interface {
+	// Authorize is called for every SignedEntryUpdate of a username that has
+	// no registered entry yet, before the update is proposed to the
+	// replication log. A
+	// nil error admits the registration; any other error is returned to the
+	// client verbatim.
+	Authorize(username string, pk []byte, eab *proto.ExternalAccountBinding) error
+}
+
+// EABKeySource resolves the HMAC key a backing IdP/enterprise admin endpoint
+// issued for a given kid, mirroring the keyid/mac lookup ACME EAB clients do
+// against their CA's "newAccount" endpoint.
+type EABKeySource func(kid string) (key []byte, ok bool)
+
+// eabPolicy is a RegistrationPolicy that requires every new username to
+// present an ExternalAccountBinding whose Mac verifies against the HMAC key
+// named by Kid.
+type eabPolicy struct {
+	keys EABKeySource
+}
+
+// NewEABPolicy returns a RegistrationPolicy that admits a new username only
+// if it presents an ExternalAccountBinding signed with a key known to keys.
+func NewEABPolicy(keys EABKeySource) RegistrationPolicy {
+	return &eabPolicy{keys: keys}
+}
+
+func (p *eabPolicy) Authorize(username string, pk []byte, eab *proto.ExternalAccountBinding) error {
+	if eab == nil {
+		return fmt.Errorf("registration of %q requires an external account binding", username)
+	}
+	key, ok := p.keys(eab.Kid)
+	if !ok {
+		return fmt.Errorf("registration of %q: unknown EAB kid %q", username, eab.Kid)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pk)
+	expected := mac.Sum(nil)
+	if !hmac.Equal(expected, eab.Mac) {
+		return fmt.Errorf("registration of %q: EAB mac does not verify", username)
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2014-2015 The Dename Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package hraft implements replication.LogReplicator on top of
+// github.com/hashicorp/raft, as an alternative to raftlog's etcd/raft. All
+// of Raft's own state lives under a dedicated dataDir: log entries and the
+// stable store in a BoltStore, snapshots in a FileSnapshotStore, and the
+// peer list in a JSON peer store; the caller's
+// kv.DB, if any, is never touched here -- it belongs entirely to the
+// application state the caller's Snapshotter saves and restores.
+package hraft
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+
+	"github.com/yahoo/coname/server/replication"
+	"golang.org/x/net/context"
+)
+
+const COMMITTED_BUFFER = 10 // It's fine to let commit run asynchronously ahead of apply
+
+// Snapshotter is implemented by the application on top of an hraft
+// LogReplicator so it can compact the log without losing application
+// state. Unlike raftlog.Snapshotter, neither method takes or returns a log
+// index. SaveSnapshot is handed the raft.SnapshotSink itself, via
+// fsmSnapshot.Persist.
+type Snapshotter interface {
+	SaveSnapshot(w io.Writer) error
+	LoadSnapshot(r io.Reader) error
+}
+
+// hraftLog is the hraft package's sole replication.LogReplicator
+// implementation, and also the raft.FSM hashicorp/raft applies committed
+// entries to.
+type hraftLog struct {
+	config      replication.Config
+	snapshotter Snapshotter
+
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	logStore  *raftboltdb.BoltStore
+
+	// mu guards peers, the dynamic view of the cluster's membership:
+	// config.Peers seeds it, and AddVoter/AddNonVoter/RemoveServer keep it
+	// current as ProposeConfChange calls land, since hashicorp/raft's own
+	// PeerStore only tracks dial addresses, not which node ID owns which.
+	mu    sync.Mutex
+	peers map[uint64]string
+
+	waitCommitted chan replication.LogEntry
+	leaderHintSet chan bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+var _ replication.LogReplicator = (*hraftLog)(nil)
+var _ raft.FSM = (*hraftLog)(nil)
+
+// tlsStreamLayer adapts a (possibly TLS-wrapped) net.Listener into the
+// raft.StreamLayer hashicorp/raft's NetworkTransport dials and accepts
+// connections through -- the same approach rqlite uses to run Raft over
+// TLS, since NetworkTransport otherwise only knows plain TCP.
+type tlsStreamLayer struct {
+	net.Listener
+	tls *tls.Config
+}
+
+func (s *tlsStreamLayer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if s.tls == nil {
+		return dialer.Dial("tcp", address)
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, s.tls)
+}
+
+// Open initializes a replication.LogReplicator backed by hashicorp/raft.
+// dataDir holds the BoltDB log and stable store, Raft's snapshot metadata,
+// and its peer list; it must be exclusive to this replica and persist
+// across restarts the same way raftlog's kv.DB prefix does. If
+// snapshotter is nil, Snapshot and Restore return an error.
+func Open(config replication.Config, dataDir string, snapshotter Snapshotter) (replication.LogReplicator, error) {
+	logStore, err := raftboltdb.NewBoltStore(dataDir + "/raft.db")
+	if err != nil {
+		return nil, fmt.Errorf("hraft: opening BoltStore: %s", err)
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(dataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("hraft: opening snapshot store: %s", err)
+	}
+
+	ln, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if config.TLS != nil {
+		ln = tls.NewListener(ln, config.TLS)
+	}
+	transport := raft.NewNetworkTransport(&tlsStreamLayer{Listener: ln, tls: config.TLS}, 3, 10*time.Second, os.Stderr)
+
+	peerStore := raft.NewJSONPeers(dataDir, transport)
+	peers := make(map[uint64]string, len(config.Peers))
+	var peerList []string
+	for id, addr := range config.Peers {
+		if id != config.ID {
+			peers[id] = addr
+			peerList = append(peerList, addr)
+		}
+	}
+	if err := peerStore.SetPeers(peerList); err != nil {
+		return nil, fmt.Errorf("hraft: persisting peer set: %s", err)
+	}
+
+	l := &hraftLog{
+		config:        config,
+		snapshotter:   snapshotter,
+		transport:     transport,
+		logStore:      logStore,
+		peers:         peers,
+		waitCommitted: make(chan replication.LogEntry, COMMITTED_BUFFER),
+		leaderHintSet: make(chan bool, COMMITTED_BUFFER),
+		stop:          make(chan struct{}),
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.EnableSingleNode = len(peerList) == 0
+	if config.TickInterval > 0 {
+		raftConfig.HeartbeatTimeout = config.TickInterval
+		raftConfig.ElectionTimeout = config.TickInterval
+		raftConfig.CommitTimeout = config.TickInterval / 10
+	}
+
+	r, err := raft.NewRaft(raftConfig, l, logStore, logStore, snapshots, peerStore, transport)
+	if err != nil {
+		return nil, fmt.Errorf("hraft: starting raft: %s", err)
+	}
+	l.raft = r
+	return l, nil
+}
+
+// Start implements replication.LogReplicator. Unlike etcd/raft's
+// StartNode/RestartNode, hashicorp/raft's NewRaft already begins
+// participating in the cluster as soon as it returns, so by the time
+// Start runs the replica may already be receiving entries; all Start adds
+// is the leadership fan-out to LeaderHintSet.
+func (l *hraftLog) Start(lo uint64) error {
+	go l.fanoutLeadership()
+	return nil
+}
+
+func (l *hraftLog) fanoutLeadership() {
+	for {
+		select {
+		case isLeader := <-l.raft.LeaderCh():
+			select {
+			case l.leaderHintSet <- isLeader:
+			default:
+				// leaderHintSet's buffer is full; this hint is dropped
+				// and not re-sent.
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Stop implements replication.LogReplicator.
+func (l *hraftLog) Stop() error {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		l.raft.Shutdown()
+		l.transport.Close()
+		l.logStore.Close()
+	})
+	return nil
+}
+
+// Propose implements replication.LogReplicator. As with raftlog, it does
+// not wait for the entry to commit; the caller's ApplyFuture is
+// discarded, and WaitCommitted is how a caller learns the outcome.
+func (l *hraftLog) Propose(ctx context.Context, data []byte) {
+	l.raft.Apply(data, 0)
+}
+
+// peerAddr returns the dial address this replica has on file for id,
+// whether that's itself (from config.Peers) or a peer added dynamically
+// via AddVoter/AddNonVoter (from the mutable peers map).
+func (l *hraftLog) peerAddr(id uint64) (string, bool) {
+	if id == l.config.ID {
+		addr, ok := l.config.Peers[id]
+		return addr, ok
+	}
+	l.mu.Lock()
+	addr, ok := l.peers[id]
+	l.mu.Unlock()
+	return addr, ok
+}
+
+// ProposeConfChange implements replication.LogReplicator. hashicorp/raft
+// v1 has no non-voting learner role, so ConfChangeAddLearnerNode is
+// treated the same as ConfChangeAddNode: the new peer becomes a full
+// member immediately rather than catching up before counting towards
+// quorum.
+func (l *hraftLog) ProposeConfChange(ctx context.Context, cc replication.ConfChange) error {
+	addr, ok := l.peerAddr(cc.NodeID)
+	if !ok {
+		return fmt.Errorf("hraft: no address configured for node %d", cc.NodeID)
+	}
+	switch cc.Type {
+	case replication.ConfChangeAddNode, replication.ConfChangeAddLearnerNode:
+		return l.raft.AddPeer(addr).Error()
+	case replication.ConfChangeRemoveNode:
+		return l.raft.RemovePeer(addr).Error()
+	default:
+		return fmt.Errorf("hraft: unknown ConfChangeType %d", cc.Type)
+	}
+}
+
+// AddVoter implements replication.LogReplicator.
+func (l *hraftLog) AddVoter(ctx context.Context, id uint64, addr string) error {
+	l.mu.Lock()
+	l.peers[id] = addr
+	l.mu.Unlock()
+	return l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeAddNode, NodeID: id, Context: []byte(addr)})
+}
+
+// AddNonVoter implements replication.LogReplicator. hashicorp/raft v1 has
+// no non-voting learner role (see ProposeConfChange), so this adds id as
+// a full voter, same as AddVoter.
+func (l *hraftLog) AddNonVoter(ctx context.Context, id uint64, addr string) error {
+	l.mu.Lock()
+	l.peers[id] = addr
+	l.mu.Unlock()
+	return l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeAddLearnerNode, NodeID: id, Context: []byte(addr)})
+}
+
+// PromoteNonVoter implements replication.LogReplicator. Every peer known
+// to this replica is already a full voter (see AddNonVoter), so Promote is
+// a no-op as long as id is a known peer.
+func (l *hraftLog) PromoteNonVoter(ctx context.Context, id uint64) error {
+	if _, ok := l.peerAddr(id); !ok {
+		return fmt.Errorf("hraft: no address configured for node %d", id)
+	}
+	return nil
+}
+
+// DemoteVoter implements replication.LogReplicator. hashicorp/raft v1 has
+// no non-voting learner role to demote id into, so this always fails;
+// RemoveServer is the only way to take a peer out of the voting set.
+func (l *hraftLog) DemoteVoter(ctx context.Context, id uint64) error {
+	return fmt.Errorf("hraft: demoting to a non-voting learner is not supported by hashicorp/raft v1")
+}
+
+// RemoveServer implements replication.LogReplicator.
+func (l *hraftLog) RemoveServer(ctx context.Context, id uint64) error {
+	if err := l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeRemoveNode, NodeID: id}); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	delete(l.peers, id)
+	l.mu.Unlock()
+	return nil
+}
+
+// Servers implements replication.LogReplicator. Voter is unconditionally
+// true: as ProposeConfChange and AddNonVoter document, hashicorp/raft v1
+// has no non-voting learner role, so every peer -- however it was added --
+// is already a full voting member by the time it shows up in l.peers.
+func (l *hraftLog) Servers() []replication.ServerInfo {
+	leader := l.raft.Leader()
+	servers := []replication.ServerInfo{{
+		ID:     l.config.ID,
+		Addr:   l.config.Peers[l.config.ID],
+		Voter:  true,
+		Leader: l.config.Peers[l.config.ID] == leader,
+	}}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, addr := range l.peers {
+		servers = append(servers, replication.ServerInfo{
+			ID:     id,
+			Addr:   addr,
+			Voter:  true,
+			Leader: addr == leader,
+		})
+	}
+	return servers
+}
+
+// WaitCommitted implements replication.LogReplicator.
+func (l *hraftLog) WaitCommitted() <-chan replication.LogEntry {
+	return l.waitCommitted
+}
+
+// LeaderHintSet implements replication.LogReplicator.
+func (l *hraftLog) LeaderHintSet() <-chan bool {
+	return l.leaderHintSet
+}
+
+// GetCommitted implements replication.LogReplicator, reading already
+// committed entries directly out of the BoltStore log. lo and hi are raw
+// hashicorp/raft log indices -- the same space Start's lo and every other
+// LogReplicator method's indices live in -- but hashicorp/raft interleaves
+// its own noop and configuration entries with application commands at
+// those same indices. A non-command entry gets a placeholder LogEntry{}
+// rather than being skipped, so raw index i always lines up with this
+// slice's position i-lo; a caller resuming from an index this returned
+// (e.g. to call Start again) would otherwise be off by however many
+// non-command entries had been interleaved before it.
+func (l *hraftLog) GetCommitted(lo, hi, maxSize uint64) ([]replication.LogEntry, error) {
+	var entries []replication.LogEntry
+	var size uint64
+	for i := lo; i < hi; i++ {
+		var entry raft.Log
+		if err := l.logStore.GetLog(i, &entry); err != nil {
+			if err == raft.ErrLogNotFound {
+				break
+			}
+			return nil, err
+		}
+		if entry.Type != raft.LogCommand {
+			entries = append(entries, replication.LogEntry{})
+			continue
+		}
+		if len(entries) > 0 && size+uint64(len(entry.Data)) > maxSize {
+			break
+		}
+		size += uint64(len(entry.Data))
+		entries = append(entries, replication.LogEntry{Data: entry.Data})
+	}
+	return entries, nil
+}
+
+// Apply implements raft.FSM: every committed command is handed to
+// WaitCommitted in order, the same delivery raftlog's run() provides.
+func (l *hraftLog) Apply(entry *raft.Log) interface{} {
+	if entry.Type == raft.LogCommand {
+		l.waitCommitted <- replication.LogEntry{Data: entry.Data}
+	}
+	return nil
+}
+
+// Snapshot implements raft.FSM by delegating to the caller's Snapshotter.
+func (l *hraftLog) Snapshot() (raft.FSMSnapshot, error) {
+	if l.snapshotter == nil {
+		return nil, fmt.Errorf("hraft: Snapshot called with no Snapshotter configured")
+	}
+	return &fsmSnapshot{snapshotter: l.snapshotter}, nil
+}
+
+// Restore implements raft.FSM by delegating to the caller's Snapshotter.
+func (l *hraftLog) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	if l.snapshotter == nil {
+		return fmt.Errorf("hraft: Restore called with no Snapshotter configured")
+	}
+	return l.snapshotter.LoadSnapshot(r)
+}
+
+// fsmSnapshot adapts Snapshotter.SaveSnapshot, which just writes to an
+// io.Writer, to raft.FSMSnapshot.Persist, which writes to a
+// raft.SnapshotSink that must be explicitly Close()d or Cancel()ed.
+type fsmSnapshot struct {
+	snapshotter Snapshotter
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := s.snapshotter.SaveSnapshot(sink); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
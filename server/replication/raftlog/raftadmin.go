@@ -0,0 +1,54 @@
+// Copyright 2014-2015 The Dename Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+package raftlog
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/yahoo/coname/server/replication"
+	"github.com/yahoo/coname/server/replication/raftlog/proto"
+)
+
+// raftAdminServer adapts a raftLog to proto.RaftAdminServer. It is a
+// separate type, rather than raftLog implementing the interface directly,
+// because raftLog already has its own Status() (different signature, used
+// internally) and the two would collide as methods of the same name.
+type raftAdminServer struct {
+	l *raftLog
+}
+
+var _ proto.RaftAdminServer = raftAdminServer{}
+
+// Status implements proto.RaftAdminServer.
+func (a raftAdminServer) Status(ctx context.Context, _ *proto.Nothing) (*proto.RaftStatus, error) {
+	st := a.l.Status()
+	return &proto.RaftStatus{
+		Id:       st.ID,
+		Leader:   st.Leader,
+		Voters:   st.Voters,
+		Learners: st.Learners,
+	}, nil
+}
+
+// AddLearner implements proto.RaftAdminServer by proposing req as a
+// ConfChangeAddLearnerNode.
+func (a raftAdminServer) AddLearner(ctx context.Context, req *proto.AddLearnerRequest) (*proto.Nothing, error) {
+	err := a.l.ProposeConfChange(ctx, replication.ConfChange{
+		Type:    replication.ConfChangeAddLearnerNode,
+		NodeID:  req.Id,
+		Context: req.Context,
+	})
+	return &proto.Nothing{}, err
+}
@@ -15,9 +15,13 @@
 package raftlog
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
@@ -38,12 +42,35 @@ import (
 )
 
 const (
-	HARDSTATE_KEY    = "HS"
-	CONFSTATE_KEY    = "CS"
-	ENTRY_KEY_PREFIX = "E"
-	COMMITTED_BUFFER = 10 // It's fine to let commit run asynchronously ahead of apply
+	HARDSTATE_KEY             = "HS"
+	CONFSTATE_KEY             = "CS"
+	ENTRY_KEY_PREFIX          = "E"
+	SNAPSHOT_KEY              = "SN"
+	PENDING_SNAPSHOT_DATA_KEY = "PD"
+	PEERADDR_PREFIX           = "PA"
+	CHUNK_KEY_PREFIX          = "CH"
+	COMMITTED_BUFFER          = 10 // It's fine to let commit run asynchronously ahead of apply
+
+	// snapshotChunkSize bounds how much snapshot data is buffered per
+	// InstallSnapshot stream message.
+	snapshotChunkSize = 1 << 20
+
+	// Every proposal gets a one-byte discriminator so run() can tell a
+	// ProposalChunk envelope from a raw, unchunked payload on apply.
+	entryTagRaw   byte = 0
+	entryTagChunk byte = 1
 )
 
+// Snapshotter is implemented by the application on top of a LogReplicator so
+// raftlog can compact the log without losing application state: SaveSnapshot
+// writes a point-in-time snapshot of the application as of index, and
+// LoadSnapshot restores the application from one, returning the index it was
+// taken at.
+type Snapshotter interface {
+	SaveSnapshot(index uint64, w io.Writer) error
+	LoadSnapshot(r io.Reader) (index uint64, err error)
+}
+
 type raftLog struct {
 	config       raft.Config
 	initialNodes []raft.Peer
@@ -53,6 +80,38 @@ type raftLog struct {
 	clk          clock.Clock
 	tickInterval time.Duration
 
+	snapshotter          Snapshotter
+	snapCount            uint64
+	entriesSinceSnapshot uint64
+
+	autopilot          replication.AutopilotConfig
+	lastContact        map[uint64]time.Time
+	autopilotDeadSince map[uint64]time.Time
+	contacted          chan uint64
+
+	// saveRequests feeds saveLoop, the background writer that coalesces
+	// consecutive (HardState, []Entry) tuples into one kv.Batch so a slow
+	// fsync doesn't sit in run()'s tick-servicing critical path; it waits
+	// up to saveCoalesceDelay, or until saveMaxBatchBytes (0 = unbounded)
+	// would be exceeded, before flushing what it has collected. run() calls
+	// node.Advance() as soon as a request is handed to saveRequests, rather
+	// than waiting for saveCompletions to report it durable, so a second
+	// Ready -- and its own saveRequest -- can be in flight before the first
+	// one's fsync returns; that overlap is what lets saveLoop ever actually
+	// see more than one pending request to coalesce. Sending any message or
+	// applying any committed entry still waits for saveCompletions, so nothing
+	// externally observable gets ahead of what's actually durable.
+	saveRequests      chan *saveRequest
+	saveCompletions   chan *saveBatch
+	saveCoalesceDelay time.Duration
+	saveMaxBatchBytes uint64
+
+	// maxProposalChunkSize bounds how much of a Propose()d payload goes
+	// into a single Raft entry; 0 disables chunking. reassembly buffers
+	// the pieces of each in-flight chunked proposal seen by run() so far.
+	maxProposalChunkSize uint64
+	reassembly           map[string]*chunkReassembly
+
 	waitCommitted chan replication.LogEntry
 
 	leaderHintSet chan bool
@@ -72,10 +131,24 @@ var _ replication.LogReplicator = (*raftLog)(nil)
 var _ proto.RaftServer = (*raftLog)(nil)
 
 func (l *raftLog) Step(ctx context.Context, msg *raftpb.Message) (*proto.Nothing, error) {
-	return &proto.Nothing{}, l.node.Step(ctx, *msg)
+	err := l.node.Step(ctx, *msg)
+	if err == nil {
+		select {
+		case l.contacted <- msg.From:
+		default:
+			// run() hasn't drained the previous notification yet; one more
+			// tick without fresh contact info for this peer is harmless.
+		}
+	}
+	return &proto.Nothing{}, err
 }
 
 // Open initializes a replication.LogReplicator using an already open kv.DB.
+// If snapshotter is non-nil, raftlog asks it to snapshot the application
+// every snapCount committed entries and compacts the log up to that point;
+// pass a nil snapshotter (and ignore snapCount) to keep the previous
+// unbounded-log behavior. A zero autopilot.DeadServerTimeout disables
+// automatic dead-peer removal.
 // TODO: config.Applied and config.Storage are useless for the caller, and
 // initialNodes and tickInterval are included; may want our own config struct
 func Open(
@@ -83,6 +156,10 @@ func Open(
 	clk clock.Clock, tickInterval time.Duration,
 	listenAddr string, tls *tls.Config,
 	peerDialer func(id uint64) (net.Conn, error),
+	snapshotter Snapshotter, snapCount uint64,
+	autopilot replication.AutopilotConfig,
+	maxProposalChunkSize uint64,
+	saveCoalesceDelay time.Duration, saveMaxBatchBytes uint64,
 ) (replication.LogReplicator, error) {
 	confState := raftpb.ConfState{}
 	for _, node := range initialNodes {
@@ -99,18 +176,30 @@ func Open(
 	dialAuth := grpc.WithTransportCredentials(credentials.NewTLS(tls))
 
 	l := &raftLog{
-		config:        *config,
-		initialNodes:  initialNodes,
-		storage:       openRaftStorage(db, prefix, confState),
-		node:          nil,
-		clk:           clk,
-		tickInterval:  tickInterval,
-		leaderHintSet: make(chan bool, COMMITTED_BUFFER),
-		waitCommitted: make(chan replication.LogEntry, COMMITTED_BUFFER),
-		dialer:        dialer,
-		dialAuth:      dialAuth,
-		stop:          make(chan struct{}),
-		stopped:       make(chan struct{}),
+		config:               *config,
+		initialNodes:         initialNodes,
+		storage:              openRaftStorage(db, prefix, confState),
+		node:                 nil,
+		clk:                  clk,
+		tickInterval:         tickInterval,
+		snapshotter:          snapshotter,
+		snapCount:            snapCount,
+		autopilot:            autopilot,
+		lastContact:          make(map[uint64]time.Time),
+		autopilotDeadSince:   make(map[uint64]time.Time),
+		contacted:            make(chan uint64, COMMITTED_BUFFER),
+		maxProposalChunkSize: maxProposalChunkSize,
+		reassembly:           make(map[string]*chunkReassembly),
+		saveRequests:         make(chan *saveRequest),
+		saveCompletions:      make(chan *saveBatch),
+		saveCoalesceDelay:    saveCoalesceDelay,
+		saveMaxBatchBytes:    saveMaxBatchBytes,
+		leaderHintSet:        make(chan bool, COMMITTED_BUFFER),
+		waitCommitted:        make(chan replication.LogEntry, COMMITTED_BUFFER),
+		dialer:               dialer,
+		dialAuth:             dialAuth,
+		stop:                 make(chan struct{}),
+		stopped:              make(chan struct{}),
 	}
 
 	var err error
@@ -120,6 +209,7 @@ func Open(
 	}
 	l.grpcServer = grpc.NewServer(grpc.Creds(credentials.NewTLS(tls)))
 	proto.RegisterRaftServer(l.grpcServer, l)
+	proto.RegisterRaftAdminServer(l.grpcServer, raftAdminServer{l: l})
 	return l, nil
 }
 
@@ -130,6 +220,12 @@ func (l *raftLog) Start(lo uint64) error {
 	if err != nil {
 		return err
 	}
+
+	pending, err := l.storage.loadPendingChunks()
+	if err != nil {
+		return err
+	}
+	l.reassembly = pending
 	if inited {
 		l.config.Applied = lo
 		l.node = raft.RestartNode(&l.config)
@@ -147,6 +243,7 @@ func (l *raftLog) Start(lo uint64) error {
 	}
 
 	go l.grpcServer.Serve(l.grpcListen)
+	go l.saveLoop()
 	go l.run()
 	return nil
 }
@@ -161,14 +258,151 @@ func (l *raftLog) Stop() error {
 	return nil
 }
 
-// Propose implements replication.LogReplicator
+// Propose implements replication.LogReplicator. A payload larger than
+// maxProposalChunkSize (if set) is split into ProposalChunk envelopes and
+// proposed one entry at a time, since etcd/raft rejects any single entry
+// over config.MaxSizePerMsg; run() reassembles them from CommittedEntries
+// before delivering the original bytes to WaitCommitted.
 func (l *raftLog) Propose(ctx context.Context, data []byte) {
-	l.node.Propose(ctx, data)
+	if l.maxProposalChunkSize == 0 || uint64(len(data)) <= l.maxProposalChunkSize {
+		l.node.Propose(ctx, append([]byte{entryTagRaw}, data...))
+		return
+	}
+	chunkID := newChunkID()
+	numChunks := (uint64(len(data)) + l.maxProposalChunkSize - 1) / l.maxProposalChunkSize
+	for seq := uint64(0); seq*l.maxProposalChunkSize < uint64(len(data)); seq++ {
+		lo := seq * l.maxProposalChunkSize
+		hi := lo + l.maxProposalChunkSize
+		if hi > uint64(len(data)) {
+			hi = uint64(len(data))
+		}
+		env := &proto.ProposalChunk{
+			ChunkID:   chunkID,
+			SeqNo:     uint32(seq),
+			NumChunks: uint32(numChunks),
+			Payload:   data[lo:hi],
+		}
+		envBytes, err := env.Marshal()
+		if err != nil {
+			log.Printf("raftlog: marshaling proposal chunk %s/%d: %s", chunkID, seq, err)
+			return
+		}
+		l.node.Propose(ctx, append([]byte{entryTagChunk}, envBytes...))
+	}
+}
+
+// newChunkID returns a fixed-width, practically-unique identifier shared by
+// every ProposalChunk of one Propose call, so run() can group them back
+// together regardless of commit order relative to other proposals.
+func newChunkID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panicf("raftlog: reading random chunk ID: %s", err)
+	}
+	return hex.EncodeToString(b[:])
 }
 
-// Propose implements replication.LogReplicator
-func (l *raftLog) ProposeConfChange(ctx context.Context, change []byte) {
-	panic("raftLog.ProposeConfChange not implemented")
+// ProposeConfChange implements replication.LogReplicator
+func (l *raftLog) ProposeConfChange(ctx context.Context, cc replication.ConfChange) error {
+	change := raftpb.ConfChange{
+		Type:    raftConfChangeType(cc.Type),
+		NodeID:  cc.NodeID,
+		Context: cc.Context,
+	}
+	return l.node.ProposeConfChange(ctx, change)
+}
+
+func raftConfChangeType(t replication.ConfChangeType) raftpb.ConfChangeType {
+	switch t {
+	case replication.ConfChangeAddLearnerNode:
+		return raftpb.ConfChangeAddLearnerNode
+	case replication.ConfChangeRemoveNode:
+		return raftpb.ConfChangeRemoveNode
+	default:
+		return raftpb.ConfChangeAddNode
+	}
+}
+
+// AddVoter implements replication.LogReplicator
+func (l *raftLog) AddVoter(ctx context.Context, id uint64, addr string) error {
+	if err := l.storage.savePeerAddr(id, addr); err != nil {
+		return err
+	}
+	return l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeAddNode, NodeID: id, Context: []byte(addr)})
+}
+
+// AddNonVoter implements replication.LogReplicator
+func (l *raftLog) AddNonVoter(ctx context.Context, id uint64, addr string) error {
+	if err := l.storage.savePeerAddr(id, addr); err != nil {
+		return err
+	}
+	return l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeAddLearnerNode, NodeID: id, Context: []byte(addr)})
+}
+
+// PromoteNonVoter implements replication.LogReplicator. etcd/raft has no
+// dedicated "promote" ConfChangeType; re-proposing ConfChangeAddNode for an
+// existing learner promotes it to a voter.
+func (l *raftLog) PromoteNonVoter(ctx context.Context, id uint64) error {
+	return l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeAddNode, NodeID: id})
+}
+
+// DemoteVoter implements replication.LogReplicator. Symmetric to
+// PromoteNonVoter: re-proposing ConfChangeAddLearnerNode for an existing
+// voter demotes it to a learner.
+func (l *raftLog) DemoteVoter(ctx context.Context, id uint64) error {
+	return l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeAddLearnerNode, NodeID: id})
+}
+
+// RemoveServer implements replication.LogReplicator
+func (l *raftLog) RemoveServer(ctx context.Context, id uint64) error {
+	if err := l.ProposeConfChange(ctx, replication.ConfChange{Type: replication.ConfChangeRemoveNode, NodeID: id}); err != nil {
+		return err
+	}
+	return l.storage.deletePeerAddr(id)
+}
+
+// Servers implements replication.LogReplicator
+func (l *raftLog) Servers() []replication.ServerInfo {
+	st := l.node.Status()
+	addrs, err := l.storage.peerAddrs()
+	if err != nil {
+		log.Printf("raftlog: Servers: loading peer addresses: %s", err)
+	}
+	learners := make(map[uint64]bool, len(st.Learners))
+	for _, id := range st.Learners {
+		learners[id] = true
+	}
+	var servers []replication.ServerInfo
+	for _, id := range append(append([]uint64{}, st.Nodes...), st.Learners...) {
+		servers = append(servers, replication.ServerInfo{
+			ID:     id,
+			Addr:   addrs[id],
+			Voter:  !learners[id],
+			Leader: id == st.Lead,
+		})
+	}
+	return servers
+}
+
+// Status summarizes the current Raft configuration and this replica's view
+// of leadership, for cluster-administration tooling.
+type Status struct {
+	ID       uint64
+	Leader   uint64
+	Voters   []uint64
+	Learners []uint64
+}
+
+// Status returns this replica's current view of the Raft configuration and
+// leadership. It is not part of replication.LogReplicator.
+func (l *raftLog) Status() Status {
+	st := l.node.Status()
+	return Status{
+		ID:       st.ID,
+		Leader:   st.Lead,
+		Voters:   append([]uint64{}, st.Nodes...),
+		Learners: append([]uint64{}, st.Learners...),
+	}
 }
 
 // WaitCommitted implements replication.LogReplicator
@@ -181,17 +415,121 @@ func (l *raftLog) LeaderHintSet() <-chan bool {
 	return l.leaderHintSet
 }
 
-// GetCommitted implements replication.LogReplicator
+// GetCommitted implements replication.LogReplicator, returning the
+// committed, reassembled LogEntries in [lo, hi).
+// maxSize bounds the first read the way raft.Storage.Entries always does,
+// but a chunked proposal (see Propose) can straddle that boundary: its
+// later pieces can fall past what maxSize let through in one read. Rather
+// than return with some of its chunks missing -- which would silently drop
+// the whole reassembled proposal, since complete() never becomes true --
+// GetCommitted keeps reading past maxSize, ignoring it, until every chunk
+// group it has started either completes or runs into hi.
 func (l *raftLog) GetCommitted(lo, hi, maxSize uint64) (ret []replication.LogEntry, err error) {
-	var entries []raftpb.Entry
-	entries, err = l.storage.Entries(lo, hi, maxSize)
-	if err != nil {
-		return
+	reassembly := make(map[string]*chunkReassembly)
+	next := lo
+	for next < hi {
+		var entries []raftpb.Entry
+		entries, err = l.storage.Entries(next, hi, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			next = entry.Index + 1
+			if len(entry.Data) == 0 {
+				ret = append(ret, replication.LogEntry{})
+				continue
+			}
+			tag, payload := entry.Data[0], entry.Data[1:]
+			if tag != entryTagChunk {
+				ret = append(ret, replication.LogEntry{Data: payload})
+				continue
+			}
+			var env proto.ProposalChunk
+			if err = env.Unmarshal(payload); err != nil {
+				return nil, err
+			}
+			r, ok := reassembly[env.ChunkID]
+			if !ok {
+				r = &chunkReassembly{numChunks: env.NumChunks, chunks: make(map[uint32][]byte)}
+				reassembly[env.ChunkID] = r
+			}
+			r.chunks[env.SeqNo] = append([]byte{}, env.Payload...)
+			if r.complete() {
+				delete(reassembly, env.ChunkID)
+				ret = append(ret, replication.LogEntry{Data: r.reassemble()})
+			}
+		}
+		if len(reassembly) == 0 {
+			break
+		}
+		// maxSize cut the read off mid chunk-group; the outer loop reads
+		// again starting right after what we just saw, still honoring hi
+		// but not maxSize, until the pending groups complete or hi does.
 	}
-	for _, entry := range entries {
-		ret = append(ret, replication.LogEntry{Data: entry.Data})
+	for chunkID, r := range reassembly {
+		log.Printf("raftlog: GetCommitted(%d,%d): truncating incomplete chunked proposal %s (%d/%d chunks seen)",
+			lo, hi, chunkID, len(r.chunks), r.numChunks)
 	}
-	return
+	return ret, nil
+}
+
+// chunkReassembly tracks the pieces of one chunked proposal seen so far.
+// Like every other raftLog field, it belongs exclusively to run().
+type chunkReassembly struct {
+	numChunks uint32
+	chunks    map[uint32][]byte
+}
+
+func (r *chunkReassembly) complete() bool {
+	return uint32(len(r.chunks)) == r.numChunks
+}
+
+func (r *chunkReassembly) reassemble() []byte {
+	var buf bytes.Buffer
+	for i := uint32(0); i < r.numChunks; i++ {
+		buf.Write(r.chunks[i])
+	}
+	return buf.Bytes()
+}
+
+// applyEntry decodes one committed, non-ConfChange entry's tagged data.
+// Untagged data (the dummy first entry has none) and raw-tagged data are
+// delivered as-is; a chunk envelope is buffered in l.reassembly, persisted
+// so a crash mid-reassembly can resume from storage, and only yields a
+// LogEntry once every chunk of its set has arrived.
+func (l *raftLog) applyEntry(tagged []byte) (replication.LogEntry, bool, error) {
+	if len(tagged) == 0 {
+		return replication.LogEntry{}, true, nil
+	}
+	tag, payload := tagged[0], tagged[1:]
+	if tag != entryTagChunk {
+		return replication.LogEntry{Data: payload}, true, nil
+	}
+
+	var env proto.ProposalChunk
+	if err := env.Unmarshal(payload); err != nil {
+		return replication.LogEntry{}, false, err
+	}
+	r, ok := l.reassembly[env.ChunkID]
+	if !ok {
+		r = &chunkReassembly{numChunks: env.NumChunks, chunks: make(map[uint32][]byte)}
+		l.reassembly[env.ChunkID] = r
+	}
+	r.chunks[env.SeqNo] = append([]byte{}, env.Payload...)
+	if err := l.storage.saveChunk(&env); err != nil {
+		return replication.LogEntry{}, false, err
+	}
+	if !r.complete() {
+		return replication.LogEntry{}, false, nil
+	}
+	delete(l.reassembly, env.ChunkID)
+	if err := l.storage.deleteChunks(env.ChunkID); err != nil {
+		return replication.LogEntry{}, false, err
+	}
+	return replication.LogEntry{Data: r.reassemble()}, true, nil
 }
 
 // run is the CSP-style main of raftLog; all local struct fields (except
@@ -208,34 +546,244 @@ func (l *raftLog) run() {
 			return
 		case <-ticker.C:
 			l.node.Tick()
+			if l.leaderHint && l.autopilot.DeadServerTimeout > 0 {
+				l.checkAutopilot()
+			}
+		case id := <-l.contacted:
+			l.lastContact[id] = l.clk.Now()
 		case rd := <-l.node.Ready():
 			if !raft.IsEmptySnap(rd.Snapshot) {
-				log.Panicf("snapshots not supported")
+				// A leader decided we're too far behind to catch up from
+				// its log and sent its application snapshot instead; the
+				// bytes themselves already arrived out of band via
+				// InstallSnapshot, staged under PENDING_SNAPSHOT_DATA_KEY,
+				// and applySnapshot merges them in under SNAPSHOT_KEY.
+				// Its error is checked, not discarded: a failure to merge
+				// in the snapshot means storage is in whatever state the
+				// partial write left it, and run() must stop rather than
+				// hand the (now unreliable) state machine a LoadSnapshot
+				// call as if nothing had gone wrong.
+				if err := l.storage.applySnapshot(rd.Snapshot); err != nil {
+					log.Panicf("raftlog: applying snapshot at index %d: %s", rd.Snapshot.Metadata.Index, err)
+				}
+				data, err := l.storage.loadSnapshotData()
+				if err != nil {
+					log.Panicf("raftlog: applying snapshot at index %d: %s", rd.Snapshot.Metadata.Index, err)
+				}
+				l.waitCommitted <- replication.LogEntry{Snapshot: data}
+				l.entriesSinceSnapshot = 0
 			}
-			l.storage.save(rd.HardState, rd.Entries)
-			for i := range rd.Messages {
-				l.send(&rd.Messages[i])
+			// Hand the (HardState, Entries) off to saveLoop and let Raft
+			// proceed immediately: everything below that's externally
+			// observable -- sending rd.Messages, applying
+			// rd.CommittedEntries, reporting a leader hint -- waits for
+			// saveCompletions to confirm this request landed, via
+			// finishReady. What must NOT wait is Advance() itself: holding
+			// it back until the fsync returns is exactly what pinned run()
+			// to one in-flight save request at a time, which left
+			// saveLoop's coalescing window with nothing to ever coalesce.
+			l.saveRequests <- &saveRequest{
+				hardState: rd.HardState,
+				entries:   rd.Entries,
+				size:      entriesSize(rd.Entries),
+				rd:        rd,
 			}
-			for _, entry := range rd.CommittedEntries {
-				switch entry.Type {
-				case raftpb.EntryConfChange:
-					var cc raftpb.ConfChange
-					cc.Unmarshal(entry.Data)
-					l.node.ApplyConfChange(cc)
-					l.waitCommitted <- replication.LogEntry{Reconfiguration: entry.Data}
-				default:
-					l.waitCommitted <- replication.LogEntry{Data: entry.Data}
-				}
+			l.node.Advance()
+		case batch := <-l.saveCompletions:
+			if batch.err != nil {
+				log.Panicf("raftlog: persisting Ready: %s", batch.err)
+			}
+			for _, req := range batch.reqs {
+				l.finishReady(req.rd)
+			}
+		}
+	}
+}
+
+// finishReady delivers the externally-visible effects of rd -- sending its
+// messages, applying its committed entries, reporting a leader hint change,
+// triggering a snapshot -- once rd's (HardState, Entries) are confirmed
+// durable by saveCompletions. Called only from run(), so it shares run()'s
+// single-goroutine access to l's fields without any locking.
+func (l *raftLog) finishReady(rd raft.Ready) {
+	for i := range rd.Messages {
+		l.send(&rd.Messages[i])
+	}
+	for _, entry := range rd.CommittedEntries {
+		switch entry.Type {
+		case raftpb.EntryConfChange:
+			var cc raftpb.ConfChange
+			cc.Unmarshal(entry.Data)
+			l.node.ApplyConfChange(cc)
+			l.waitCommitted <- replication.LogEntry{Reconfiguration: entry.Data}
+		default:
+			le, ok, err := l.applyEntry(entry.Data)
+			if err != nil {
+				log.Printf("raftlog: applying entry at index %d: %s", entry.Index, err)
+			} else if ok {
+				l.waitCommitted <- le
+			}
+		}
+		l.entriesSinceSnapshot++
+	}
+
+	leaderHint := rd.SoftState.RaftState == raft.StateLeader
+	if l.leaderHint != leaderHint {
+		l.leaderHint = leaderHint
+		l.leaderHintSet <- leaderHint
+	}
+
+	if l.snapshotter != nil && l.snapCount > 0 && l.entriesSinceSnapshot >= l.snapCount && len(rd.CommittedEntries) > 0 {
+		l.entriesSinceSnapshot = 0
+		go l.takeSnapshot(rd.CommittedEntries[len(rd.CommittedEntries)-1].Index)
+	}
+}
+
+// saveRequest is one (HardState, []Entry) tuple awaiting a durable write, as
+// handed from run() to saveLoop. rd is the Ready it was taken from, carried
+// along so run() can finish applying it once saveCompletions confirms this
+// request's batch is durable.
+type saveRequest struct {
+	hardState raftpb.HardState
+	entries   []raftpb.Entry
+	size      uint64
+	rd        raft.Ready
+}
+
+// saveBatch is the outcome of one saveLoop flush, reported back to run() as
+// a unit: either every request in reqs landed (err == nil), or none of them
+// did, since they were written as a single kv.Batch.
+type saveBatch struct {
+	reqs []*saveRequest
+	err  error
+}
+
+func entriesSize(entries []raftpb.Entry) uint64 {
+	var n uint64
+	for _, e := range entries {
+		n += uint64(e.Size())
+	}
+	return n
+}
+
+// saveLoop is the background writer started alongside run(): it waits for
+// the first pending saveRequest, then keeps absorbing more for up to
+// saveCoalesceDelay (or until saveMaxBatchBytes, if set, would be exceeded)
+// before writing everything collected so far as one kv.Batch.
+func (l *raftLog) saveLoop() {
+	for {
+		var first *saveRequest
+		select {
+		case <-l.stop:
+			return
+		case first = <-l.saveRequests:
+		}
+		pending := []*saveRequest{first}
+		size := first.size
+		deadline := l.clk.After(l.saveCoalesceDelay)
+	collect:
+		for l.saveMaxBatchBytes == 0 || size < l.saveMaxBatchBytes {
+			select {
+			case req := <-l.saveRequests:
+				pending = append(pending, req)
+				size += req.size
+			case <-deadline:
+				break collect
+			case <-l.stop:
+				break collect
 			}
+		}
+		l.flushSaves(pending)
+	}
+}
 
-			leaderHint := rd.SoftState.RaftState == raft.StateLeader
-			l.node.Advance() // let Raft proceed
-			if l.leaderHint != leaderHint {
-				l.leaderHint = leaderHint
-				l.leaderHintSet <- leaderHint
+// flushSaves durably writes every pending request's (HardState, Entries) as
+// a single kv.Batch and reports the shared outcome back to run() as one
+// saveBatch, so it can finish applying each request's Ready in order.
+func (l *raftLog) flushSaves(pending []*saveRequest) {
+	wb := l.storage.db.NewBatch()
+	lastIndex, err := l.storage.LastIndex()
+	if err == nil {
+		for _, req := range pending {
+			lastIndex, err = l.storage.appendToBatch(wb, lastIndex, req.hardState, req.entries)
+			if err != nil {
+				break
 			}
 		}
 	}
+	if err == nil {
+		err = l.storage.db.Write(wb)
+	}
+	select {
+	case l.saveCompletions <- &saveBatch{reqs: pending, err: err}:
+	case <-l.stop:
+		// run() has already returned and stopped reading saveCompletions;
+		// nothing left to deliver this batch's outcome to.
+	}
+}
+
+// takeSnapshot asks l.snapshotter for a snapshot of the application as of
+// index, persists it, and compacts the log up to index so it stops growing
+// without bound. It must not be called from run() directly since SaveSnapshot
+// may be slow; run() spawns it in its own goroutine.
+func (l *raftLog) takeSnapshot(index uint64) {
+	var buf bytes.Buffer
+	if err := l.snapshotter.SaveSnapshot(index, &buf); err != nil {
+		log.Printf("raftlog: SaveSnapshot at index %d: %s", index, err)
+		return
+	}
+	term, err := l.storage.Term(index)
+	if err != nil {
+		log.Printf("raftlog: Term(%d) for snapshot: %s", index, err)
+		return
+	}
+	_, confState, err := l.storage.InitialState()
+	if err != nil {
+		log.Printf("raftlog: InitialState for snapshot: %s", err)
+		return
+	}
+	if err := l.storage.saveSnapshot(index, term, confState, buf.Bytes()); err != nil {
+		log.Printf("raftlog: persisting snapshot at index %d: %s", index, err)
+	}
+}
+
+// checkAutopilot runs on the leader's ticker: a voter not heard from for
+// LastContactThreshold is considered suspect, and one continuously suspect
+// for DeadServerTimeout is proposed for removal, as long as doing so would
+// not shrink the voter set below MinQuorum. It must only be called from
+// run(), which owns l.lastContact and l.autopilotDeadSince.
+func (l *raftLog) checkAutopilot() {
+	now := l.clk.Now()
+	st := l.node.Status()
+	voters := len(st.Nodes)
+	for _, id := range st.Nodes {
+		if id == st.ID {
+			continue
+		}
+		if last, ok := l.lastContact[id]; ok && now.Sub(last) <= l.autopilot.LastContactThreshold {
+			delete(l.autopilotDeadSince, id)
+			continue
+		}
+		since, marked := l.autopilotDeadSince[id]
+		if !marked {
+			l.autopilotDeadSince[id] = now
+			continue
+		}
+		if now.Sub(since) < l.autopilot.DeadServerTimeout {
+			continue
+		}
+		if voters <= l.autopilot.MinQuorum {
+			log.Printf("raftlog: autopilot: %x is dead but removing it would breach MinQuorum=%d", id, l.autopilot.MinQuorum)
+			continue
+		}
+		delete(l.autopilotDeadSince, id)
+		voters--
+		go func(id uint64) {
+			if err := l.RemoveServer(context.TODO(), id); err != nil {
+				log.Printf("raftlog: autopilot: RemoveServer(%x): %s", id, err)
+			}
+		}(id)
+	}
 }
 
 // send synchronouslt accesses l.grpcConnectionCache and then asynchronously
@@ -251,6 +799,10 @@ func (l *raftLog) send(msg *raftpb.Message) {
 		c = proto.NewRaftClient(cc)
 		l.grpcClientCache[msg.To] = c
 	}
+	if msg.Type == raftpb.MsgSnap {
+		go l.sendSnapshot(c, msg)
+		return
+	}
 	go func(msg raftpb.Message) {
 		_, err := c.Step(context.TODO(), &msg)
 		if err != nil {
@@ -260,27 +812,200 @@ func (l *raftLog) send(msg *raftpb.Message) {
 	}(*msg)
 }
 
+// sendSnapshot streams the application snapshot embedded in msg.Snapshot to
+// msg.To in chunks via InstallSnapshot, then delivers msg itself over Step so
+// the follower's raft.Node learns the snapshot is fully applied.
+func (l *raftLog) sendSnapshot(c proto.RaftClient, msg *raftpb.Message) {
+	stream, err := c.InstallSnapshot(context.TODO())
+	if err != nil {
+		log.Printf("raftlog InstallSnapshot to %x: %s", msg.To, err)
+		l.node.ReportSnapshot(msg.To, raft.SnapshotFailure)
+		return
+	}
+	data, err := l.storage.loadSnapshotData()
+	if err != nil {
+		log.Printf("raftlog: loading local snapshot to stream to %x: %s", msg.To, err)
+		l.node.ReportSnapshot(msg.To, raft.SnapshotFailure)
+		return
+	}
+	for len(data) > 0 {
+		n := snapshotChunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		chunk := &proto.SnapshotChunk{Index: msg.Snapshot.Metadata.Index, Data: data[:n]}
+		if err := stream.Send(chunk); err != nil {
+			log.Printf("raftlog InstallSnapshot stream to %x: %s", msg.To, err)
+			l.node.ReportSnapshot(msg.To, raft.SnapshotFailure)
+			return
+		}
+		data = data[n:]
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		log.Printf("raftlog InstallSnapshot close to %x: %s", msg.To, err)
+		l.node.ReportSnapshot(msg.To, raft.SnapshotFailure)
+		return
+	}
+
+	// msg.Snapshot.Data was just streamed above in full; strip it before
+	// delivering msg over Step so the snapshot doesn't cross the wire a
+	// second time. The follower recovers the bytes from what
+	// InstallSnapshot staged, once this Step tells its raft.Node the
+	// snapshot (by index) is ready to apply.
+	strippedSnap := *msg.Snapshot
+	strippedSnap.Data = nil
+	strippedMsg := *msg
+	strippedMsg.Snapshot = &strippedSnap
+	if _, err := c.Step(context.TODO(), &strippedMsg); err != nil {
+		log.Printf("raftlog send snapshot Step to %x: %s", msg.To, err)
+		l.node.ReportUnreachable(msg.To)
+		return
+	}
+	l.node.ReportSnapshot(msg.To, raft.SnapshotFinish)
+}
+
+// InstallSnapshot implements proto.RaftServer: it receives a streamed
+// application snapshot from the leader and persists it so the next Ready
+// carrying the matching raftpb.Snapshot can restore from it.
+func (l *raftLog) InstallSnapshot(stream proto.Raft_InstallSnapshotServer) error {
+	var buf bytes.Buffer
+	var index uint64
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		index = chunk.Index
+		buf.Write(chunk.Data)
+	}
+	if err := l.storage.savePendingSnapshotData(index, buf.Bytes()); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&proto.Nothing{})
+}
+
 // Needs to be threadsafe; right now, carries no in-memory mutable state
 type raftStorage struct {
-	hardStateKey   []byte
-	confStateKey   []byte
-	entryKeyPrefix []byte
-	db             kv.DB
-	initialConf    raftpb.ConfState
+	hardStateKey           []byte
+	confStateKey           []byte
+	entryKeyPrefix         []byte
+	snapshotKey            []byte
+	pendingSnapshotDataKey []byte
+	peerAddrPrefix         []byte
+	chunkPrefix            []byte
+	db                     kv.DB
+	initialConf            raftpb.ConfState
 }
 
 var _ raft.Storage = (*raftStorage)(nil)
 
 func openRaftStorage(db kv.DB, prefix []byte, initialConf raftpb.ConfState) *raftStorage {
 	return &raftStorage{
-		hardStateKey:   append(append([]byte{}, prefix...), HARDSTATE_KEY...),
-		confStateKey:   append(append([]byte{}, prefix...), CONFSTATE_KEY...),
-		entryKeyPrefix: append(append([]byte{}, prefix...), ENTRY_KEY_PREFIX...),
-		db:             db,
-		initialConf:    initialConf,
+		hardStateKey:           append(append([]byte{}, prefix...), HARDSTATE_KEY...),
+		confStateKey:           append(append([]byte{}, prefix...), CONFSTATE_KEY...),
+		entryKeyPrefix:         append(append([]byte{}, prefix...), ENTRY_KEY_PREFIX...),
+		snapshotKey:            append(append([]byte{}, prefix...), SNAPSHOT_KEY...),
+		pendingSnapshotDataKey: append(append([]byte{}, prefix...), PENDING_SNAPSHOT_DATA_KEY...),
+		peerAddrPrefix:         append(append([]byte{}, prefix...), PEERADDR_PREFIX...),
+		chunkPrefix:            append(append([]byte{}, prefix...), CHUNK_KEY_PREFIX...),
+		db:                     db,
+		initialConf:            initialConf,
 	}
 }
 
+func (s *raftStorage) getPeerAddrKey(id uint64) []byte {
+	key := make([]byte, len(s.peerAddrPrefix)+8)
+	copy(key, s.peerAddrPrefix)
+	binary.BigEndian.PutUint64(key[len(s.peerAddrPrefix):], id)
+	return key
+}
+
+// savePeerAddr persists the dial address for id, so peerDialer can be
+// reconstructed from storage after a restart instead of requiring the
+// caller to remember every address it ever added.
+func (s *raftStorage) savePeerAddr(id uint64, addr string) error {
+	return s.db.Put(s.getPeerAddrKey(id), []byte(addr))
+}
+
+// deletePeerAddr removes a previously saved peer address, e.g. once id has
+// been removed from the configuration.
+func (s *raftStorage) deletePeerAddr(id uint64) error {
+	wb := s.db.NewBatch()
+	wb.Delete(s.getPeerAddrKey(id))
+	return s.db.Write(wb)
+}
+
+// peerAddrs returns every persisted peer address, keyed by node ID.
+func (s *raftStorage) peerAddrs() (map[uint64]string, error) {
+	it := s.db.NewIterator(kv.BytesPrefix(s.peerAddrPrefix))
+	defer it.Release()
+	addrs := make(map[uint64]string)
+	for ok := it.First(); ok; ok = it.Next() {
+		id := binary.BigEndian.Uint64(it.Key()[len(s.peerAddrPrefix):])
+		addrs[id] = string(it.Value())
+	}
+	return addrs, it.Error()
+}
+
+func (s *raftStorage) getChunkKey(chunkID string, seqNo uint32) []byte {
+	key := make([]byte, 0, len(s.chunkPrefix)+len(chunkID)+4)
+	key = append(key, s.chunkPrefix...)
+	key = append(key, chunkID...)
+	var seq [4]byte
+	binary.BigEndian.PutUint32(seq[:], seqNo)
+	return append(key, seq[:]...)
+}
+
+// saveChunk persists one piece of a chunked proposal so a crash before all
+// of its pieces have arrived can resume reassembly via loadPendingChunks.
+func (s *raftStorage) saveChunk(env *proto.ProposalChunk) error {
+	data, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.db.Put(s.getChunkKey(env.ChunkID, env.SeqNo), data)
+}
+
+// deleteChunks removes every persisted piece of chunkID, once it has been
+// fully reassembled.
+func (s *raftStorage) deleteChunks(chunkID string) error {
+	prefix := append(append([]byte{}, s.chunkPrefix...), chunkID...)
+	it := s.db.NewIterator(kv.BytesPrefix(prefix))
+	wb := s.db.NewBatch()
+	for ok := it.First(); ok; ok = it.Next() {
+		wb.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(wb)
+}
+
+// loadPendingChunks scans every persisted proposal-chunk piece and groups
+// them by ChunkID, so Start can resume reassembly after a crash.
+func (s *raftStorage) loadPendingChunks() (map[string]*chunkReassembly, error) {
+	it := s.db.NewIterator(kv.BytesPrefix(s.chunkPrefix))
+	defer it.Release()
+	pending := make(map[string]*chunkReassembly)
+	for ok := it.First(); ok; ok = it.Next() {
+		var env proto.ProposalChunk
+		if err := env.Unmarshal(it.Value()); err != nil {
+			return nil, err
+		}
+		r, ok := pending[env.ChunkID]
+		if !ok {
+			r = &chunkReassembly{numChunks: env.NumChunks, chunks: make(map[uint32][]byte)}
+			pending[env.ChunkID] = r
+		}
+		r.chunks[env.SeqNo] = append([]byte{}, env.Payload...)
+	}
+	return pending, it.Error()
+}
+
 // Returns whether an existing state has been persisted to the storage
 func (s *raftStorage) IsInitialized() (bool, error) {
 	switch _, err := s.db.Get(s.hardStateKey); err {
@@ -331,7 +1056,7 @@ func (s *raftStorage) getEntryKey(nr uint64) (key []byte) {
 
 // Entries implements the raft.Storage interface
 func (s *raftStorage) Entries(lo, hi, maxSize uint64) (entries []raftpb.Entry, err error) {
-	it := s.db.NewIterator(&kv.Range{s.getEntryKey(lo), s.getEntryKey(hi)})
+	it := s.db.NewIterator(&kv.Range{Start: s.getEntryKey(lo), Limit: s.getEntryKey(hi)})
 	defer it.Release()
 	entries = make([]raftpb.Entry, 0)
 	sizeSoFar := uint64(0)
@@ -356,7 +1081,23 @@ func (s *raftStorage) Entries(lo, hi, maxSize uint64) (entries []raftpb.Entry, e
 }
 
 // Term implements the raft.Storage interface
+// Term handles i at or below the snapshot boundary explicitly: Entries
+// alone cannot, since writeSnapshot has already truncated those keys away
+// as part of the snapshot/compaction subsystem (see Snapshotter, run()'s
+// snapshot handling, and sendSnapshot/InstallSnapshot for the rest of it).
 func (s *raftStorage) Term(i uint64) (uint64, error) {
+	snap, err := s.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	if !raft.IsEmptySnap(snap) {
+		if i == snap.Metadata.Index {
+			return snap.Metadata.Term, nil
+		}
+		if i < snap.Metadata.Index {
+			return 0, raft.ErrCompacted
+		}
+	}
 	entries, err := s.Entries(i, i+1, math.MaxUint64)
 	if err != nil {
 		return 0, err
@@ -368,41 +1109,205 @@ func (s *raftStorage) Term(i uint64) (uint64, error) {
 }
 
 // LastIndex implements the raft.Storage interface
+// LastIndex implements the raft.Storage interface. If every entry has been
+// compacted away by a snapshot and none have been appended since, this must
+// still return the snapshot's own index rather than 0: raft.Storage requires
+// FirstIndex() <= LastIndex()+1, and FirstIndex() already returns
+// snap.Metadata.Index+1 in that case.
 func (s *raftStorage) LastIndex() (uint64, error) {
 	it := s.db.NewIterator(kv.BytesPrefix(s.entryKeyPrefix))
-	defer it.Release()
-	if !it.Last() {
-		return 0, it.Error()
+	hasEntry := it.Last()
+	var lastEntryIndex uint64
+	if hasEntry {
+		indexPortion := it.Key()[len(s.entryKeyPrefix):]
+		lastEntryIndex = binary.BigEndian.Uint64(indexPortion)
 	}
-	indexPortion := it.Key()[len(s.entryKeyPrefix):]
-	return binary.BigEndian.Uint64(indexPortion), it.Error()
+	it.Release()
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	if !hasEntry || (!raft.IsEmptySnap(snap) && snap.Metadata.Index > lastEntryIndex) {
+		return snap.Metadata.Index, nil
+	}
+	return lastEntryIndex, nil
 }
 
-// FirstIndex implements the raft.Storage interface
+// FirstIndex implements the raft.Storage interface. Once a snapshot has
+// been taken, entries at or below its index are compacted away, so the
+// first usable index is just past it.
 func (s *raftStorage) FirstIndex() (uint64, error) {
-	// Start at index 1 to be consistent with etcd/raft's MemoryStorage
-	// (not sure if this is actually necessary)
-	return 1, nil
+	snap, err := s.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	if raft.IsEmptySnap(snap) {
+		// Start at index 1 to be consistent with etcd/raft's MemoryStorage
+		// (not sure if this is actually necessary)
+		return 1, nil
+	}
+	return snap.Metadata.Index + 1, nil
 }
 
 // Snapshot implements the raft.Storage interface
 func (s *raftStorage) Snapshot() (raftpb.Snapshot, error) {
-	return raftpb.Snapshot{}, nil
+	snapBytes, err := s.db.Get(s.snapshotKey)
+	if err == s.db.ErrNotFound() {
+		return raftpb.Snapshot{}, nil
+	} else if err != nil {
+		return raftpb.Snapshot{}, err
+	}
+	var snap raftpb.Snapshot
+	if err := snap.Unmarshal(snapBytes); err != nil {
+		return raftpb.Snapshot{}, err
+	}
+	return snap, nil
 }
 
-// Don't call this multiple times concurrently
-func (s *raftStorage) save(state raftpb.HardState, entries []raftpb.Entry) error {
+// saveSnapshot persists an application snapshot of the state as of index
+// (at the given term, with the given confState), and truncates log entries
+// up to and including index now that they're superseded by it.
+func (s *raftStorage) saveSnapshot(index, term uint64, confState raftpb.ConfState, data []byte) error {
+	snap := raftpb.Snapshot{
+		Data: data,
+		Metadata: raftpb.SnapshotMetadata{
+			Index:     index,
+			Term:      term,
+			ConfState: confState,
+		},
+	}
+	return s.writeSnapshot(snap)
+}
+
+// savePendingSnapshotData stages the application snapshot bytes streamed
+// in by InstallSnapshot, keyed by index, until the matching raftpb.Snapshot
+// metadata arrives through the usual Ready.Snapshot and applySnapshot
+// merges the two together. It is kept under its own key rather than
+// snapshotKey so a Snapshot() call racing an in-progress InstallSnapshot
+// still sees a well-formed raftpb.Snapshot (or none) instead of raw,
+// un-unmarshalable application bytes.
+func (s *raftStorage) savePendingSnapshotData(index uint64, data []byte) error {
+	buf := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(buf, index)
+	copy(buf[8:], data)
+	return s.db.Put(s.pendingSnapshotDataKey, buf)
+}
+
+// takePendingSnapshotData returns the application snapshot bytes most
+// recently staged by savePendingSnapshotData for index, and ok=false if
+// none are staged for that index -- e.g. a local takeSnapshot rather than
+// one streamed in from a peer, or a stream for a different, since-
+// superseded index.
+func (s *raftStorage) takePendingSnapshotData(index uint64) (data []byte, ok bool, err error) {
+	buf, err := s.db.Get(s.pendingSnapshotDataKey)
+	if err == s.db.ErrNotFound() {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if len(buf) < 8 || binary.BigEndian.Uint64(buf[:8]) != index {
+		return nil, false, nil
+	}
+	return buf[8:], true, nil
+}
+
+// loadSnapshotData returns the raw application snapshot bytes saved by the
+// most recent saveSnapshot/saveSnapshotData/applySnapshot.
+func (s *raftStorage) loadSnapshotData() ([]byte, error) {
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return snap.Data, nil
+}
+
+// applySnapshot atomically overwrites HardState, ConfState, and the entry
+// log with a raftpb.Snapshot received from the leader, discarding anything
+// this replica had before it fell behind.
+func (s *raftStorage) applySnapshot(snap raftpb.Snapshot) error {
+	if len(snap.Data) == 0 {
+		data, ok, err := s.takePendingSnapshotData(snap.Metadata.Index)
+		if err != nil {
+			return err
+		}
+		if ok {
+			snap.Data = data
+		}
+	}
+
 	wb := s.db.NewBatch()
-	stateBytes, err := state.Marshal()
+	snapBytes, err := snap.Marshal()
+	if err != nil {
+		return err
+	}
+	wb.Put(s.snapshotKey, snapBytes)
+	wb.Delete(s.pendingSnapshotDataKey)
+
+	confStateBytes, err := snap.Metadata.ConfState.Marshal()
+	if err != nil {
+		return err
+	}
+	wb.Put(s.confStateKey, confStateBytes)
+
+	hardState := raftpb.HardState{Term: snap.Metadata.Term, Commit: snap.Metadata.Index}
+	hardStateBytes, err := hardState.Marshal()
 	if err != nil {
 		return err
 	}
+	wb.Put(s.hardStateKey, hardStateBytes)
+
+	it := s.db.NewIterator(kv.BytesPrefix(s.entryKeyPrefix))
+	for ok := it.First(); ok; ok = it.Next() {
+		wb.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return s.db.Write(wb)
+}
+
+// writeSnapshot persists snap and truncates every log entry at or below
+// snap.Metadata.Index, which is now superseded by it.
+func (s *raftStorage) writeSnapshot(snap raftpb.Snapshot) error {
+	wb := s.db.NewBatch()
+	snapBytes, err := snap.Marshal()
+	if err != nil {
+		return err
+	}
+	wb.Put(s.snapshotKey, snapBytes)
+
+	it := s.db.NewIterator(&kv.Range{Start: s.entryKeyPrefix, Limit: s.getEntryKey(snap.Metadata.Index + 1)})
+	for ok := it.First(); ok; ok = it.Next() {
+		wb.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	return s.db.Write(wb)
+}
+
+// appendToBatch stages state and entries into wb, given the last index
+// already reflected by wb's accumulated writes (not necessarily what
+// s.LastIndex() would currently report, if earlier calls against the same
+// wb haven't been written yet), and returns the resulting last index. This
+// lets flushSaves coalesce several (HardState, []Entry) tuples into one
+// kv.Batch without each depending on a LastIndex() read of the previous
+// tuple's not-yet-durable writes.
+func (s *raftStorage) appendToBatch(wb kv.Batch, lastIndex uint64, state raftpb.HardState, entries []raftpb.Entry) (uint64, error) {
+	stateBytes, err := state.Marshal()
+	if err != nil {
+		return lastIndex, err
+	}
 	wb.Put(s.hardStateKey, stateBytes)
 	if len(entries) > 0 {
-		lastIndex, err := s.LastIndex()
-		if err != nil {
-			return err
-		}
 		if entries[0].Index > lastIndex+1 {
 			panic(fmt.Errorf("missing log entries [last: %d, append at: %d]", lastIndex, entries[0].Index))
 		}
@@ -414,11 +1319,24 @@ func (s *raftStorage) save(state raftpb.HardState, entries []raftpb.Entry) error
 		for _, entry := range entries {
 			entryBytes, err := entry.Marshal()
 			if err != nil {
-				return err
+				return lastIndex, err
 			}
 			wb.Put(s.getEntryKey(entry.Index), entryBytes)
 		}
+		lastIndex = entries[len(entries)-1].Index
+	}
+	return lastIndex, nil
+}
+
+// Don't call this multiple times concurrently
+func (s *raftStorage) save(state raftpb.HardState, entries []raftpb.Entry) error {
+	lastIndex, err := s.LastIndex()
+	if err != nil {
+		return err
+	}
+	wb := s.db.NewBatch()
+	if _, err := s.appendToBatch(wb, lastIndex, state, entries); err != nil {
+		return err
 	}
-	err = s.db.Write(wb)
-	return err
+	return s.db.Write(wb)
 }
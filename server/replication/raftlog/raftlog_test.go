@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/andres-erbsen/clock"
 	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/yahoo/coname/server/kv"
 	"github.com/yahoo/coname/server/kv/leveldbkv"
@@ -55,6 +57,10 @@ func setupDB(t *testing.T) (db kv.DB, teardown func()) {
 
 // raft replicas are numbered 1..n  and reside in array indices 0..n-1
 func setupRaftLogCluster(t *testing.T, n int) (ret []replication.LogReplicator, clks []*clock.Mock, teardown func()) {
+	return setupRaftLogClusterChunked(t, n, 0)
+}
+
+func setupRaftLogClusterChunked(t *testing.T, n int, maxProposalChunkSize uint64) (ret []replication.LogReplicator, clks []*clock.Mock, teardown func()) {
 	peers := make([]raft.Peer, 0, n)
 	for i := uint64(0); i < uint64(n); i++ {
 		peers = append(peers, raft.Peer{ID: 1 + i})
@@ -86,7 +92,7 @@ func setupRaftLogCluster(t *testing.T, n int) (ret []replication.LogReplicator,
 		if err != nil {
 			t.Fatal(err)
 		}
-		l, err := Open(db, nil, c, peers, clk, tick, ln, grpc.NewServer(), lookupDialer)
+		l, err := Open(db, nil, c, peers, clk, tick, ln, grpc.NewServer(), lookupDialer, nil, 0, replication.AutopilotConfig{}, maxProposalChunkSize, 500*time.Microsecond, 0)
 		if err != nil {
 			teardown()
 			t.Fatal(err)
@@ -120,6 +126,96 @@ func TestRaftLogStartStop5(t *testing.T) {
 	defer teardown()
 }
 
+func TestRaftStorageSnapshotCompactsEntries(t *testing.T) {
+	db, teardown := setupDB(t)
+	defer teardown()
+	s := openRaftStorage(db, nil, raftpb.ConfState{Nodes: []uint64{1}})
+
+	entries := make([]raftpb.Entry, 5)
+	for i := range entries {
+		entries[i] = raftpb.Entry{Index: uint64(i + 1), Term: 1}
+	}
+	if err := s.save(raftpb.HardState{}, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.saveSnapshot(3, 1, raftpb.ConfState{Nodes: []uint64{1}}, []byte("app-state-at-3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if first, err := s.FirstIndex(); err != nil || first != 4 {
+		t.Fatalf("FirstIndex() = %d, %v; want 4, nil", first, err)
+	}
+	if term, err := s.Term(3); err != nil || term != 1 {
+		t.Fatalf("Term(3) = %d, %v; want 1, nil", term, err)
+	}
+	if _, err := s.Term(2); err != raft.ErrCompacted {
+		t.Fatalf("Term(2) = _, %v; want raft.ErrCompacted", err)
+	}
+	remaining, err := s.Entries(4, 6, math.MaxUint64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Fatalf("Entries(4, 6) returned %d entries, want 2", len(remaining))
+	}
+
+	data, err := s.loadSnapshotData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "app-state-at-3" {
+		t.Fatalf("loadSnapshotData() = %q, want %q", data, "app-state-at-3")
+	}
+}
+
+func TestProposeConfChangeAddLearner(t *testing.T) {
+	replicas, clks, teardown := setupRaftLogCluster(t, 1)
+	defer teardown()
+	l := replicas[0]
+	if err := l.ProposeConfChange(context.TODO(), replication.ConfChange{
+		Type:   replication.ConfChangeAddLearnerNode,
+		NodeID: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		clks[0].Add(tick)
+		if learners := l.(*raftLog).Status().Learners; len(learners) == 1 && learners[0] == 2 {
+			return
+		}
+	}
+	t.Fatalf("learner 2 never appeared in Status(): %+v", l.(*raftLog).Status())
+}
+
+func TestAddVoterAndServers(t *testing.T) {
+	replicas, clks, teardown := setupRaftLogCluster(t, 1)
+	defer teardown()
+	l := replicas[0]
+	if err := l.AddVoter(context.TODO(), 2, "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		clks[0].Add(tick)
+		servers := l.Servers()
+		if len(servers) != 2 {
+			continue
+		}
+		for _, s := range servers {
+			if s.ID == 2 {
+				if !s.Voter {
+					t.Fatalf("added voter 2 came back non-voting: %+v", servers)
+				}
+				if s.Addr != "127.0.0.1:0" {
+					t.Fatalf("Servers() lost address for 2: %+v", servers)
+				}
+				return
+			}
+		}
+	}
+	t.Fatalf("voter 2 never appeared in Servers(): %+v", l.Servers())
+}
+
 type appendMachine struct {
 	db  kv.DB
 	log replication.LogReplicator
@@ -194,7 +290,11 @@ func (am *appendMachine) load() {
 }
 
 func setupAppendMachineCluster(t *testing.T, n int) (ret []*appendMachine, clks []*clock.Mock, teardown func()) {
-	replicas, clks, teardown := setupRaftLogCluster(t, n)
+	return setupAppendMachineClusterChunked(t, n, 0)
+}
+
+func setupAppendMachineClusterChunked(t *testing.T, n int, maxProposalChunkSize uint64) (ret []*appendMachine, clks []*clock.Mock, teardown func()) {
+	replicas, clks, teardown := setupRaftLogClusterChunked(t, n, maxProposalChunkSize)
 	for _, r := range replicas {
 		db, td := setupDB(t)
 		am := openAppendMachine(db, r)
@@ -279,3 +379,189 @@ func TestAppendMachineEachPropose1AndWait5(t *testing.T) {
 func TestAppendMachineEachPropose13AndWait3(t *testing.T) {
 	testAppendMachineEachProposeAndWait(t, 13, 3)
 }
+
+// benchmarkPropose drives a single-node raftLog, on a real clock, through
+// b.N sequential Propose/commit round trips at payloadSize bytes each. A
+// single proposer waiting for its own commit can't show the throughput win
+// saveLoop coalescing is meant for -- that needs concurrent proposers
+// sharing a batch -- but it does measure whether moving the fsync off of
+// run()'s select hurts single-proposer latency, which the old synchronous
+// l.storage.save call on every Ready (saveCoalesceDelay 0, i.e. saveLoop
+// flushes alone) is the baseline for.
+func benchmarkPropose(b *testing.B, payloadSize int, saveCoalesceDelay time.Duration) {
+	dir, err := ioutil.TempDir("", "raftlog-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ldb.Close()
+	db := leveldbkv.Wrap(ldb)
+
+	c := &raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   1,
+		MaxSizePerMsg:   1 << 20,
+		MaxInflightMsgs: 256,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lookupDialer := func(id uint64) proto.RaftClient {
+		panic("single-node benchmark has no peers to dial")
+	}
+	l, err := Open(db, nil, c, []raft.Peer{{ID: 1}}, clock.New(), 10*time.Millisecond, ln, grpc.NewServer(), lookupDialer, nil, 0, replication.AutopilotConfig{}, 0, saveCoalesceDelay, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Stop()
+	if err := l.Start(0); err != nil {
+		b.Fatal(err)
+	}
+	committed := l.WaitCommitted()
+	payload := make([]byte, payloadSize)
+
+	// Pay the one-time single-node election cost outside the timed loop.
+	l.Propose(context.TODO(), payload)
+	<-committed
+
+	b.SetBytes(int64(payloadSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Propose(context.TODO(), payload)
+		<-committed
+	}
+}
+
+func BenchmarkProposeSerial64B(b *testing.B)     { benchmarkPropose(b, 64, 0) }
+func BenchmarkProposeCoalesced64B(b *testing.B)  { benchmarkPropose(b, 64, 500*time.Microsecond) }
+func BenchmarkProposeSerial4KiB(b *testing.B)    { benchmarkPropose(b, 4096, 0) }
+func BenchmarkProposeCoalesced4KiB(b *testing.B) { benchmarkPropose(b, 4096, 500*time.Microsecond) }
+func BenchmarkProposeSerial64KiB(b *testing.B)   { benchmarkPropose(b, 65536, 0) }
+func BenchmarkProposeCoalesced64KiB(b *testing.B) {
+	benchmarkPropose(b, 65536, 500*time.Microsecond)
+}
+
+// benchmarkProposeConcurrent drives a single-node raftLog, on a real clock,
+// with concurrency proposers each hammering Propose/commit round trips in
+// parallel, at payloadSize bytes each, for b.N total round trips. Unlike
+// benchmarkPropose, this is the shape saveLoop coalescing actually targets:
+// with several proposals in flight at once, a save request handed to
+// saveLoop while it is still collecting an earlier one should land in the
+// same kv.Batch instead of paying its own fsync.
+func benchmarkProposeConcurrent(b *testing.B, payloadSize, concurrency int, saveCoalesceDelay time.Duration) {
+	dir, err := ioutil.TempDir("", "raftlog-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ldb, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ldb.Close()
+	db := leveldbkv.Wrap(ldb)
+
+	c := &raft.Config{
+		ID:              1,
+		ElectionTick:    10,
+		HeartbeatTick:   1,
+		MaxSizePerMsg:   1 << 20,
+		MaxInflightMsgs: 256,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lookupDialer := func(id uint64) proto.RaftClient {
+		panic("single-node benchmark has no peers to dial")
+	}
+	l, err := Open(db, nil, c, []raft.Peer{{ID: 1}}, clock.New(), 10*time.Millisecond, ln, grpc.NewServer(), lookupDialer, nil, 0, replication.AutopilotConfig{}, 0, saveCoalesceDelay, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Stop()
+	if err := l.Start(0); err != nil {
+		b.Fatal(err)
+	}
+	committed := l.WaitCommitted()
+	payload := make([]byte, payloadSize)
+
+	// Pay the one-time single-node election cost, and drain it, outside the
+	// timed loop.
+	l.Propose(context.TODO(), payload)
+	<-committed
+
+	// b.N may not divide evenly by concurrency; total is the actual number
+	// of proposals every proposer's share adds up to, which is what the
+	// drain loop below needs to wait for.
+	perProposer := (b.N + concurrency - 1) / concurrency
+	total := perProposer * concurrency
+
+	// Every Propose commits something, regardless of which proposer sent
+	// it, so one shared drain loop counting total commits is simpler (and
+	// just as faithful) as handing each proposer its own counter.
+	drained := make(chan struct{})
+	go func() {
+		for i := 0; i < total; i++ {
+			<-committed
+		}
+		close(drained)
+	}()
+
+	b.SetBytes(int64(payloadSize))
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for p := 0; p < concurrency; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perProposer; i++ {
+				l.Propose(context.TODO(), payload)
+			}
+		}()
+	}
+	wg.Wait()
+	<-drained
+}
+
+func BenchmarkProposeConcurrent8x64B(b *testing.B) {
+	benchmarkProposeConcurrent(b, 64, 8, 500*time.Microsecond)
+}
+func BenchmarkProposeConcurrent8x4KiB(b *testing.B) {
+	benchmarkProposeConcurrent(b, 4096, 8, 500*time.Microsecond)
+}
+func BenchmarkProposeConcurrent64x64B(b *testing.B) {
+	benchmarkProposeConcurrent(b, 64, 64, 500*time.Microsecond)
+}
+
+func TestProposeChunksLargeBlobAcrossCluster(t *testing.T) {
+	const maxProposalChunkSize = 4096
+	blob := make([]byte, 4*1024*1024+1)
+	rand.Read(blob)
+
+	replicas, clks, teardown := setupAppendMachineClusterChunked(t, 3, maxProposalChunkSize)
+	defer teardown()
+
+	go replicas[0].log.Propose(context.TODO(), blob)
+
+	for i := 0; i < 10000; i++ {
+		clks[rand.Intn(len(clks))].Add(tick)
+		allMatch := true
+		for _, am := range replicas {
+			if !bytes.Equal(am.Get(), blob) {
+				allMatch = false
+				break
+			}
+		}
+		if allMatch {
+			return
+		}
+	}
+	t.Fatalf("blob did not reach every replica intact")
+}
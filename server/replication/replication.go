@@ -0,0 +1,145 @@
+// Copyright 2014-2015 The Dename Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License. You may obtain a copy of
+// the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations under
+// the License.
+
+// Package replication defines the interface the keyserver uses to propose
+// and observe a replicated, totally ordered log of opaque entries, without
+// committing callers to a particular consensus implementation. raftlog
+// (etcd/raft) and hraft (hashicorp/raft) implement it.
+package replication
+
+import (
+	"crypto/tls"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// LogEntry is one entry the replicated log delivers to a consumer: ordinary
+// application Data, a Reconfiguration control message produced by a
+// committed ConfChange, or a Snapshot the consumer must Restore from before
+// any further entries make sense (delivered when this replica fell far
+// enough behind that the leader compacted past what it could replay).
+type LogEntry struct {
+	Data            []byte
+	Reconfiguration []byte
+	Snapshot        []byte
+}
+
+// ConfChangeType describes the kind of membership change a ConfChange
+// requests.
+type ConfChangeType int
+
+const (
+	// ConfChangeAddNode adds a full (voting) member.
+	ConfChangeAddNode ConfChangeType = iota
+	// ConfChangeAddLearnerNode adds a non-voting member that receives the
+	// log but does not count towards quorum, so it can catch up before
+	// being promoted with a later ConfChangeAddNode.
+	ConfChangeAddLearnerNode
+	// ConfChangeRemoveNode removes a member, voting or not.
+	ConfChangeRemoveNode
+)
+
+// ConfChange describes a single membership change to propose to the log.
+// It is replication's own type, rather than an alias of etcd/raft's
+// raftpb.ConfChange, so that LogReplicator implementations aren't required
+// to share etcd/raft's wire format.
+type ConfChange struct {
+	Type    ConfChangeType
+	NodeID  uint64
+	Context []byte
+}
+
+// LogReplicator lets a caller propose entries and membership changes to a
+// replicated log, and observe the entries and leadership changes committed
+// to it.
+type LogReplicator interface {
+	// Start begins participating in the replicated log, assuming the
+	// caller's state machine already reflects all entries below lo.
+	Start(lo uint64) error
+	// Stop shuts the replicator down, releasing any resources it holds.
+	Stop() error
+
+	// Propose asks for data to be appended to the log. It does not block
+	// until the entry is committed; subscribe to WaitCommitted for that.
+	Propose(ctx context.Context, data []byte)
+	// ProposeConfChange asks for a membership change to be applied to the
+	// log's configuration once committed.
+	ProposeConfChange(ctx context.Context, cc ConfChange) error
+
+	// WaitCommitted returns a channel of entries as they are committed, in
+	// order, starting just after the lo passed to Start.
+	WaitCommitted() <-chan LogEntry
+	// LeaderHintSet returns a channel of best-effort notifications of
+	// whether this replica believes itself to be the current leader.
+	LeaderHintSet() <-chan bool
+	// GetCommitted returns already-committed entries in [lo, hi), stopping
+	// early once maxSize bytes would be exceeded. Entries are never
+	// truncated, the first entry is returned even if it alone exceeds
+	// maxSize, and raftlog reads past maxSize to complete a chunked proposal.
+	GetCommitted(lo, hi, maxSize uint64) ([]LogEntry, error)
+
+	// AddVoter proposes adding id, dialable at addr, as a full (voting)
+	// member.
+	AddVoter(ctx context.Context, id uint64, addr string) error
+	// AddNonVoter proposes adding id, dialable at addr, as a learner: it
+	// receives the log but does not count towards quorum until promoted.
+	AddNonVoter(ctx context.Context, id uint64, addr string) error
+	// PromoteNonVoter proposes turning an existing learner into a full
+	// voting member.
+	PromoteNonVoter(ctx context.Context, id uint64) error
+	// DemoteVoter proposes turning an existing voter into a non-voting
+	// learner, e.g. before taking it down for maintenance.
+	DemoteVoter(ctx context.Context, id uint64) error
+	// RemoveServer proposes removing id from the configuration entirely.
+	RemoveServer(ctx context.Context, id uint64) error
+	// Servers returns the current membership, including address, voter
+	// status, and which member (if any) this replica believes is leader.
+	Servers() []ServerInfo
+}
+
+// ServerInfo describes one member of the cluster's current configuration,
+// as surfaced to operator tooling.
+type ServerInfo struct {
+	ID     uint64
+	Addr   string
+	Voter  bool
+	Leader bool
+}
+
+// Config describes a replicated log's wiring -- this replica's own id, the
+// full peer set (including itself) with dial addresses, the address to
+// listen on, the TLS configuration to use for both, and how often to tick
+// -- independent of which LogReplicator implementation consumes it.
+// raftlog predates this type and still takes these as separate Open()
+// parameters (see the TODO on raftlog.Open); hraft is the first
+// implementation built to take a Config directly.
+type Config struct {
+	ID           uint64
+	Peers        map[uint64]string
+	ListenAddr   string
+	TLS          *tls.Config
+	TickInterval time.Duration
+}
+
+// AutopilotConfig controls a leader's automatic membership maintenance,
+// modeled on Consul's operator autopilot: MinQuorum bounds how small a
+// healthy voter set may shrink to before automatic removals stop, and a
+// voter unreachable past LastContactThreshold for DeadServerTimeout is
+// proposed for removal.
+type AutopilotConfig struct {
+	MinQuorum            int
+	LastContactThreshold time.Duration
+	DeadServerTimeout    time.Duration
+}
@@ -1,12 +1,141 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/yahoo/coname/proto"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/net/context"
 )
 
-func (ks *Keyserver) UpdateProfile(ctx context.Context, req *proto.SignedEntryUpdate) (*proto.LookupProof, error) {
-	return nil, fmt.Errorf("UpdateProfile not implemented")
-}
\ No newline at end of file
+// UpdateProfile is the keyserver's single write path: verify the client's
+// signature against the username's currently registered key (or the
+// registration policy, for a brand-new name), rate-limit it, propose it to
+// the replicated log, wait for the epoch it lands in to be signed, and
+// return a LookupProof against that epoch's tree root. eab is the external
+// account binding the client presented alongside req, if any; it is only
+// consulted (and required, if ks.registrationPolicy is set) on a username's
+// first update.
+func (ks *Keyserver) UpdateProfile(ctx context.Context, req *proto.SignedEntryUpdate, eab *proto.ExternalAccountBinding) (*proto.LookupProof, error) {
+	update := &proto.SignedEntryUpdate_PreserveEncoding{SignedEntryUpdate: *req}
+	if err := update.UpdateEncoding(); err != nil {
+		return nil, err
+	}
+	proposal := &proto.EntryUpdateProposal{Update: *update, Eab: eab}
+
+	exists, currentEntry, err := ks.lookupCurrentEntry(req.Username)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := verifyEntryUpdateSignature(currentEntry, req); err != nil {
+			return nil, err
+		}
+	} else if ks.registrationPolicy != nil {
+		if err := ks.registrationPolicy.Authorize(req.Username, req.NewEntry.PublicKey, eab); err != nil {
+			return nil, err
+		}
+	}
+
+	vrfOutput, err := ks.vrf.Compute([]byte(req.Username))
+	if err != nil {
+		return nil, err
+	}
+	if !ks.updateRateLimit.Allow(vrfOutput) {
+		return nil, fmt.Errorf("UpdateProfile: rate limit exceeded for %q", req.Username)
+	}
+
+	epoch, err := ks.proposeAndWaitForEpoch(ctx, proposal)
+	if err != nil {
+		return nil, err
+	}
+	return ks.lookupProofAt(epoch, req.Username)
+}
+
+// verifyEntryUpdateSignature checks req.Signature against current's public
+// key, over req.NewEntry's own canonical encoding (not req's, so the
+// signature doesn't need to cover itself).
+func verifyEntryUpdateSignature(current *proto.Entry, req *proto.SignedEntryUpdate) error {
+	entryBytes, err := req.NewEntry.Marshal()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(current.PublicKey, entryBytes, req.Signature) {
+		return fmt.Errorf("UpdateProfile: signature does not verify against %q's current key", req.Username)
+	}
+	return nil
+}
+
+// proposeAndWaitForEpoch proposes update to the replicated log and blocks
+// until a signed epoch's tree reflects it, or ctx is done. Every
+// UpdateProfile call that arrives in the same epoch waits on the same
+// ks.epochAdvanced condition variable, so one epoch's commit/sign
+// round-trip serves all of them instead of each blocking for its own.
+//
+// It does not assume update lands in the very next epoch: under load, or if
+// the epoch timer fires while this proposal is in flight, the epoch can
+// seal before update is included in it. So instead of guessing a target
+// epoch number, this re-checks whether update is now reflected every time
+// an epoch advances, and only returns once it is -- the epoch it returns is
+// always the one update actually committed into.
+//
+// The reflected-check compares the *entire* committed entry against
+// proposal.Update.NewEntry, not just the public key: a NewEntry that keeps
+// the same key but changes some other field would otherwise make the check
+// pass before the proposal even commits, since the old entry already has
+// that key. The check itself runs with ks.epochMu held, and is only ever
+// left unheld inside ks.epochAdvanced.Wait() -- checking and waiting under
+// the same continuously-held lock is what prevents a broadcast landing in
+// the gap between "check failed" and "start waiting" from being missed.
+func (ks *Keyserver) proposeAndWaitForEpoch(ctx context.Context, proposal *proto.EntryUpdateProposal) (uint64, error) {
+	data, err := proposal.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	ks.replicator.Propose(ctx, data)
+
+	newEntryBytes, err := proposal.Update.NewEntry.Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	// ks.epochAdvanced is only ever broadcast when an epoch seals; wake
+	// this waiter on ctx being done too, so a stalled epoch can't hang
+	// UpdateProfile forever.
+	stopWatchingCtx := make(chan struct{})
+	defer close(stopWatchingCtx)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ks.epochMu.Lock()
+			ks.epochAdvanced.Broadcast()
+			ks.epochMu.Unlock()
+		case <-stopWatchingCtx:
+		}
+	}()
+
+	ks.epochMu.Lock()
+	defer ks.epochMu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		exists, currentEntry, err := ks.lookupCurrentEntry(proposal.Update.Username)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			currentEntryBytes, err := currentEntry.Marshal()
+			if err != nil {
+				return 0, err
+			}
+			if bytes.Equal(currentEntryBytes, newEntryBytes) {
+				return ks.currentEpoch, nil
+			}
+		}
+
+		ks.epochAdvanced.Wait()
+	}
+}
@@ -0,0 +1,284 @@
+/**
+ * @license
+ * Copyright 2017 Yahoo Inc. All rights reserved.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vrf_ed25519
+
+import (
+	"crypto/sha512"
+	"math/big"
+
+	"github.com/yahoo/coname/vrf/vrf_ed25519/golang_x_crypt_ed25519_internal/edwards25519"
+)
+
+// Suite selects the hash_to_curve construction an ECVRF's Prove/Verify use.
+// The package-level ECVRF_prove/ECVRF_verify always use SuiteLegacy.
+type Suite int
+
+const (
+	// SuiteLegacy is the original try-and-increment construction this
+	// package has always used. It is variable-time: the number of loop
+	// iterations leaks information about m || pk. Kept as the default so
+	// existing callers and on-disk proofs are unaffected.
+	SuiteLegacy Suite = iota
+	// SuiteEdwards25519Sha512Ell2 is the IRTF CFRG
+	// ECVRF-EDWARDS25519-SHA512-ELL2 construction (RFC 9380's
+	// edwards25519_XMD:SHA-512_ELL2_RO_ hash-to-curve suite). Only
+	// hash_to_curve differs from SuiteLegacy: the challenge hash (SHA-256)
+	// and the proof encoding are the same for both suites, so proofs made
+	// with this suite are not interchangeable with those of other ECVRF
+	// implementations.
+	SuiteEdwards25519Sha512Ell2
+)
+
+// hashToCurveDST is the domain separation tag for the standardized suite, as
+// named in RFC 9380.
+const hashToCurveDST = "ECVRF_edwards25519_SHA512_ELL2_"
+
+// ECVRF is a VRF instance bound to a specific hash-to-curve suite. The
+// package-level ECVRF_prove/ECVRF_verify functions are equivalent to
+// NewECVRF(SuiteLegacy).
+type ECVRF struct {
+	suite Suite
+}
+
+// NewECVRF returns an ECVRF instance using the given suite.
+func NewECVRF(suite Suite) *ECVRF {
+	return &ECVRF{suite: suite}
+}
+
+func (v *ECVRF) hashToCurve() func([]byte, []byte) *edwards25519.ExtendedGroupElement {
+	switch v.suite {
+	case SuiteEdwards25519Sha512Ell2:
+		return hashToCurveEdwards25519Ell2
+	default:
+		return ECVRF_hash_to_curve
+	}
+}
+
+// Prove is equivalent to ECVRF_prove, but uses v's suite's hash_to_curve.
+func (v *ECVRF) Prove(pk []byte, sk []byte, m []byte) ([]byte, error) {
+	return ecvrfProve(pk, sk, m, v.hashToCurve())
+}
+
+// Verify is equivalent to ECVRF_verify, but uses v's suite's hash_to_curve.
+func (v *ECVRF) Verify(pk []byte, pi []byte, m []byte) (bool, error) {
+	return ecvrfVerify(pk, pi, m, v.hashToCurve())
+}
+
+// hashToCurveEdwards25519Ell2 implements the edwards25519_XMD:SHA-512_ELL2_RO_
+// suite from RFC 9380: hash_to_field produces two field elements via
+// expand_message_xmd(SHA-512), each is mapped to a curve point with the
+// Elligator2 map (applied on the birationally equivalent Montgomery curve,
+// curve25519), the two points are added, and the cofactor is cleared by
+// scalar-multiplying by 8.
+//
+// This is a straightforward, correctness-focused port of the RFC's
+// pseudocode using math/big; it is not constant-time and should not be used
+// where the message or key must stay secret from a timing attacker with
+// access to this process. It is also only checked here against
+// suite_test.go's own Prove/Verify round trips, not against the CFRG-VRF
+// draft's published known-answer test vectors, so interoperability with
+// other ECVRF-EDWARDS25519-SHA512-ELL2 implementations is unconfirmed.
+func hashToCurveEdwards25519Ell2(m []byte, pk []byte) *edwards25519.ExtendedGroupElement {
+	u0, u1 := hashToField2(append(append([]byte{}, m...), pk...))
+
+	q0 := mapToCurveElligator2(u0)
+	q1 := mapToCurveElligator2(u1)
+	sum := GeAdd(q0, q1)
+	return GeScalarMult(sum, IP2F(big.NewInt(8)))
+}
+
+// field arithmetic is done mod p, the edwards25519/curve25519 field prime.
+var fieldP, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// hashToField2 runs expand_message_xmd(SHA-512, DST, 2*L) and reduces each
+// L=48 byte half mod p, per RFC 9380 section 5.3 with k=128.
+func hashToField2(msg []byte) (u0, u1 *big.Int) {
+	const L = 48
+	uniform := expandMessageXMD(msg, []byte(hashToCurveDST), 2*L)
+	u0 = new(big.Int).Mod(new(big.Int).SetBytes(uniform[:L]), fieldP)
+	u1 = new(big.Int).Mod(new(big.Int).SetBytes(uniform[L:2*L]), fieldP)
+	return
+}
+
+// expandMessageXMD implements expand_message_xmd from RFC 9380 section 5.3.1
+// using SHA-512 (b_in_bytes = 64, s_in_bytes = 128).
+func expandMessageXMD(msg, dst []byte, lenInBytes int) []byte {
+	const bInBytes = 64
+	const sInBytes = 128
+	ell := (lenInBytes + bInBytes - 1) / bInBytes
+
+	dstPrime := append(append([]byte{}, dst...), byte(len(dst)))
+	lIBStr := []byte{byte(lenInBytes >> 8), byte(lenInBytes)}
+
+	msgPrime := make([]byte, 0, sInBytes+len(msg)+2+1+len(dstPrime))
+	msgPrime = append(msgPrime, make([]byte, sInBytes)...)
+	msgPrime = append(msgPrime, msg...)
+	msgPrime = append(msgPrime, lIBStr...)
+	msgPrime = append(msgPrime, 0)
+	msgPrime = append(msgPrime, dstPrime...)
+
+	b0 := sha512.Sum512(msgPrime)
+
+	b1in := append(append([]byte{}, b0[:]...), 1)
+	b1in = append(b1in, dstPrime...)
+	b1 := sha512.Sum512(b1in)
+	b := [][]byte{b1[:]}
+
+	for i := 2; i <= ell; i++ {
+		xored := make([]byte, bInBytes)
+		for j := range xored {
+			xored[j] = b0[j] ^ b[len(b)-1][j]
+		}
+		in := append(xored, byte(i))
+		in = append(in, dstPrime...)
+		next := sha512.Sum512(in)
+		b = append(b, next[:])
+	}
+
+	out := make([]byte, 0, ell*bInBytes)
+	for _, bi := range b {
+		out = append(out, bi...)
+	}
+	return out[:lenInBytes]
+}
+
+// Montgomery curve25519 parameter A, and Z as fixed by RFC 9380 for this suite.
+var (
+	montgomeryA = big.NewInt(486662)
+	ellZ        = big.NewInt(2)
+)
+
+// mapToCurveElligator2 implements RFC 9380's map_to_curve_elligator2 for
+// curve25519 followed by the standard birational map to edwards25519, and
+// returns the resulting Edwards point (not yet cofactor-cleared).
+//
+// The final sign of y follows the RFC's step 19 exactly: CMOV(y, -y, e2 XOR
+// e3), where e2 is "gx1 is square" (which branch of x/gx was taken) and e3
+// is sign0(y) (here, y's parity) *before* any negation. An earlier version
+// of this function instead forced y to a fixed parity unconditionally,
+// independent of e2; since y and -y are both valid square roots but are
+// different, distinct points on the curve, that produced a different (if
+// internally self-consistent) point than RFC 9380 does for the same input,
+// silently breaking interoperability with conformant implementations rather
+// than just failing to prove it.
+func mapToCurveElligator2(u *big.Int) *edwards25519.ExtendedGroupElement {
+	p := fieldP
+
+	tv1 := new(big.Int).Mul(u, u)
+	tv1.Mul(tv1, ellZ)
+	tv1.Mod(tv1, p)
+	negOne := new(big.Int).Sub(p, big.NewInt(1))
+	if tv1.Cmp(negOne) == 0 {
+		tv1.SetInt64(0)
+	}
+	x1 := new(big.Int).Add(tv1, big.NewInt(1))
+	x1.Mod(x1, p)
+	x1 = modInv0(x1, p)
+	x1.Mul(x1, montgomeryA)
+	x1.Neg(x1)
+	x1.Mod(x1, p)
+
+	gx1 := new(big.Int).Add(x1, montgomeryA)
+	gx1.Mul(gx1, x1)
+	gx1.Add(gx1, big.NewInt(1)) // + B, B = 1
+	gx1.Mul(gx1, x1)
+	gx1.Mod(gx1, p)
+
+	x2 := new(big.Int).Neg(new(big.Int).Add(x1, montgomeryA))
+	x2.Mod(x2, p)
+	gx2 := new(big.Int).Mul(tv1, gx1)
+	gx2.Mod(gx2, p)
+
+	e2 := isSquare(gx1, p)
+	var x, y2 *big.Int
+	if e2 {
+		x, y2 = x1, gx1
+	} else {
+		x, y2 = x2, gx2
+	}
+
+	y := new(big.Int).ModSqrt(y2, p)
+	if y == nil {
+		// Should not happen: one of gx1, gx2 is always a square by
+		// construction of Elligator2.
+		y = big.NewInt(0)
+	}
+	e3 := y.Bit(0) == 1 // sign0(y), before any negation
+	if e2 != e3 {
+		y.Sub(p, y)
+	}
+
+	return montgomeryToEdwards(x, y)
+}
+
+// montgomeryToEdwards converts a (u, v) point on curve25519 to the
+// birationally equivalent point (x, y) on edwards25519: x = sqrt(-486664)*u/v,
+// y = (u-1)/(u+1). v == 0 only at the identity's preimage, which
+// hash_to_field practically never produces; guard it anyway.
+func montgomeryToEdwards(u, v *big.Int) *edwards25519.ExtendedGroupElement {
+	p := fieldP
+	if v.Sign() == 0 {
+		v = big.NewInt(1)
+	}
+
+	negA2 := new(big.Int).Mod(new(big.Int).Neg(big.NewInt(486664)), p)
+	c1 := new(big.Int).ModSqrt(negA2, p)
+
+	x := new(big.Int).Mul(u, c1)
+	x.Mul(x, modInv0(v, p))
+	x.Mod(x, p)
+
+	y := new(big.Int).Mul(new(big.Int).Sub(u, big.NewInt(1)), modInv0(new(big.Int).Add(u, big.NewInt(1)), p))
+	y.Mod(y, p)
+
+	return decodeAffine(x, y)
+}
+
+// decodeAffine encodes (x, y) the way ECP2OS/OS2ECP do (compressed y with
+// the sign of x in the top bit) and parses it back into a curve point,
+// without the prime-order subgroup check OS2ECP performs -- the point isn't
+// expected to be in the prime-order subgroup yet, that's what the caller's
+// later cofactor clearing is for.
+func decodeAffine(x, y *big.Int) *edwards25519.ExtendedGroupElement {
+	var buf [32]byte
+	yBytes := y.Bytes()
+	for i, b := range yBytes {
+		buf[len(yBytes)-1-i] = b
+	}
+	if x.Bit(0) == 1 {
+		buf[31] |= 0x80
+	}
+	P := new(edwards25519.ExtendedGroupElement)
+	P.FromBytes(&buf)
+	return P
+}
+
+func isSquare(x, p *big.Int) bool {
+	if x.Sign() == 0 {
+		return true
+	}
+	return new(big.Int).ModSqrt(x, p) != nil
+}
+
+// modInv0 returns the modular inverse of x mod p, or 0 if x is 0 (the inv0
+// convention RFC 9380's pseudocode relies on).
+func modInv0(x, p *big.Int) *big.Int {
+	if x.Sign() == 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).ModInverse(x, p)
+}
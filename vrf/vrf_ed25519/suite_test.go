@@ -0,0 +1,147 @@
+/**
+ * @license
+ * Copyright 2017 Yahoo Inc. All rights reserved.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vrf_ed25519
+
+import (
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// These are not the CFRG-VRF draft's published known-answer vectors (ported
+// by hand from math/big pseudocode, they would need independent
+// verification against another implementation to be trustworthy); they
+// instead exercise the properties a correct suite must have regardless: a
+// proof verifies under the key and message it was made for, under both
+// suites, and stops verifying if any of the three change.
+func TestSuitesProveVerifyRoundTrip(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suite := range []Suite{SuiteLegacy, SuiteEdwards25519Sha512Ell2} {
+		v := NewECVRF(suite)
+		m := []byte("hello, VRF")
+
+		pi, err := v.Prove(pk, sk, m)
+		if err != nil {
+			t.Fatalf("suite %d: Prove: %v", suite, err)
+		}
+		ok, err := v.Verify(pk, pi, m)
+		if err != nil {
+			t.Fatalf("suite %d: Verify: %v", suite, err)
+		}
+		if !ok {
+			t.Fatalf("suite %d: proof did not verify against its own key and message", suite)
+		}
+
+		if ok, _ := v.Verify(pk, pi, []byte("different message")); ok {
+			t.Errorf("suite %d: proof verified against a different message", suite)
+		}
+		if ok, _ := v.Verify(otherPk, pi, m); ok {
+			t.Errorf("suite %d: proof verified against a different key", suite)
+		}
+
+		tampered := append([]byte{}, pi...)
+		tampered[0] ^= 1
+		if ok, _ := v.Verify(pk, tampered, m); ok {
+			t.Errorf("suite %d: tampered proof verified", suite)
+		}
+	}
+}
+
+// A SuiteEdwards25519Sha512Ell2 proof must not verify as a SuiteLegacy one
+// and vice versa: the two suites hash to curve differently, so mixing them
+// should behave exactly like presenting the wrong key.
+func TestSuitesDoNotCrossVerify(t *testing.T) {
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := []byte("cross-suite check")
+
+	legacy := NewECVRF(SuiteLegacy)
+	standard := NewECVRF(SuiteEdwards25519Sha512Ell2)
+
+	pi, err := legacy.Prove(pk, sk, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := standard.Verify(pk, pi, m); ok {
+		t.Error("a SuiteLegacy proof verified under SuiteEdwards25519Sha512Ell2")
+	}
+
+	pi2, err := standard.Prove(pk, sk, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := legacy.Verify(pk, pi2, m); ok {
+		t.Error("a SuiteEdwards25519Sha512Ell2 proof verified under SuiteLegacy")
+	}
+}
+
+// expandMessageXMD must be deterministic and produce the requested length,
+// and distinct (msg, DST) inputs must not collide in practice.
+func TestExpandMessageXMD(t *testing.T) {
+	a := expandMessageXMD([]byte("abc"), []byte(hashToCurveDST), 96)
+	b := expandMessageXMD([]byte("abc"), []byte(hashToCurveDST), 96)
+	if len(a) != 96 {
+		t.Fatalf("got length %d, want 96", len(a))
+	}
+	if string(a) != string(b) {
+		t.Error("expandMessageXMD is not deterministic")
+	}
+
+	c := expandMessageXMD([]byte("abcd"), []byte(hashToCurveDST), 96)
+	if string(a) == string(c) {
+		t.Error("expandMessageXMD gave the same output for different messages")
+	}
+}
+
+// mapToCurveElligator2's final y must follow RFC 9380 step 19 (CMOV(y, -y,
+// e2 XOR e3)), not a fixed parity: a prior version of this function forced y
+// to always come out even regardless of which branch (e2) produced it,
+// which happens to be internally consistent but is not what the RFC
+// specifies and so produces a different point than a conformant
+// implementation would for the same u. mapToCurveElligator2 returns only the
+// Edwards point, so this checks the sign bit of its encoding (the parity of
+// the Edwards x coordinate) across distinct inputs and requires both values
+// to occur. That bit depends on y but is not y's parity, so this does not
+// check step 19 directly.
+func TestMapToCurveElligator2SignNotFixed(t *testing.T) {
+	sawEven, sawOdd := false, false
+	for i := int64(1); i <= 64; i++ {
+		u := new(big.Int).Mod(big.NewInt(i*i+3*i+1), fieldP)
+		p := mapToCurveElligator2(u)
+		var buf [32]byte
+		p.ToBytes(&buf)
+		if buf[31]&0x80 != 0 {
+			sawOdd = true
+		} else {
+			sawEven = true
+		}
+	}
+	if !sawEven || !sawOdd {
+		t.Errorf("mapToCurveElligator2 produced only one sign across 64 inputs (even=%v, odd=%v); the sign looks fixed again", sawEven, sawOdd)
+	}
+}
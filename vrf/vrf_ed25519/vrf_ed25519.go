@@ -18,6 +18,7 @@ package vrf_ed25519
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
 	"errors"
@@ -55,8 +56,12 @@ const (
 
 // assume <pk, sk> were generated by ed25519.GenerateKey()
 func ECVRF_prove(pk []byte, sk []byte, m []byte) (pi []byte, err error) {
+	return ecvrfProve(pk, sk, m, ECVRF_hash_to_curve)
+}
+
+func ecvrfProve(pk []byte, sk []byte, m []byte, hashToCurve func([]byte, []byte) *edwards25519.ExtendedGroupElement) (pi []byte, err error) {
 	x := expandSecret(sk)
-	h := ECVRF_hash_to_curve(m, pk)
+	h := hashToCurve(m, pk)
 	r := ECP2OS(GeScalarMult(h, x))
 
 	kp, ks, err := ed25519.GenerateKey(nil)	// use GenerateKey to generate a random
@@ -85,6 +90,10 @@ func ECVRF_proof2hash(pi []byte) []byte {
 }
 
 func ECVRF_verify(pk []byte, pi []byte, m []byte) (bool, error) {
+	return ecvrfVerify(pk, pi, m, ECVRF_hash_to_curve)
+}
+
+func ecvrfVerify(pk []byte, pi []byte, m []byte, hashToCurve func([]byte, []byte) *edwards25519.ExtendedGroupElement) (bool, error) {
 	r, c, s, err := ECVRF_decode_proof(pi)
 	if err != nil {
 		return false, err
@@ -98,7 +107,7 @@ func ECVRF_verify(pk []byte, pi []byte, m []byte) (bool, error) {
 	}
 	edwards25519.GeDoubleScalarMultVartime(&u, c, P, s)
 
-	h := ECVRF_hash_to_curve(m, pk)
+	h := hashToCurve(m, pk)
 
 	// v = gamma^c * h^s
 //	fmt.Printf("c, r, s, h\n%s%s%s%s\n", hex.Dump(c[:]), hex.Dump(ECP2OS(r)), hex.Dump(s[:]), hex.Dump(ECP2OS(h)))
@@ -291,6 +300,133 @@ func ToCached(r *CachedGroupElement, p *edwards25519.ExtendedGroupElement) {
 	edwards25519.FeMul(&r.T2d, &p.T, &d2)
 }
 
+// ECVRF_prove_batch computes one proof per message in msgs against the same
+// (pk, sk). It is a plain convenience wrapper around ECVRF_prove -- each
+// proof still does its own hash_to_curve and scalar multiplications -- not
+// an amortized or constant-time batch operation.
+//
+// Real amortization across the batch (e.g. a windowed/NAF precomputed table
+// for the fixed scalar x, shared across every h^x in the batch) is closed as
+// out of scope rather than attempted here: golang_x_crypt_ed25519_internal/
+// edwards25519 exposes GeDoubleScalarMultVartime as its only multi-term
+// scalar multiplication primitive, and that computes a*A + b*B for B fixed
+// to the standard base point -- it has no variant for a fixed-but-arbitrary
+// second point, which is what precomputing against x's own point would
+// need. Building that precomputation (or a general Straus/Pippenger MSM) by
+// hand, on top of this package's own GeAdd/ToCached formulas, would be new
+// constant-time-sensitive elliptic-curve code in a package with no proof of
+// correctness to lean on beyond suite_test.go's round trips -- a timing leak
+// or an off-by-one in such code fails silently (a proof that still verifies,
+// just not the one RFC 9381 intends, or a key-recovery side channel), and
+// there is no test vector or build in this tree that would catch it. Ship
+// the honest per-proof loop; revisit with a vetted MSM implementation
+// (and known-answer tests) rather than a hand-rolled one.
+func ECVRF_prove_batch(pk []byte, sk []byte, msgs [][]byte) (pis [][]byte, err error) {
+	pis = make([][]byte, len(msgs))
+	for i, m := range msgs {
+		pis[i], err = ECVRF_prove(pk, sk, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pis, nil
+}
+
+// ECVRFBatchItem is one (message, proof) pair to be checked by
+// ECVRF_verify_batch.
+type ECVRFBatchItem struct {
+	M  []byte
+	Pi []byte
+}
+
+// ECVRF_verify_batch checks many proofs against a single public key. Unlike
+// ECVRF_verify, which decodes pk on every call, it decodes pk once for the
+// whole batch; otherwise it does the same per-item work ECVRF_verify would
+// (one hash_to_curve and the double/single scalar multiplications), so this
+// is not the Pippenger/Straus multi-scalar combination that would let the
+// whole batch share a single multiplication -- that optimization is closed
+// as out of scope here, for the same reason documented on
+// ECVRF_prove_batch: the only multi-term scalar multiplication this package
+// has access to (GeDoubleScalarMultVartime) is hardwired to the standard
+// base point as its second term, so sharing work across P (the one point
+// that actually repeats across every item in the batch) would require a
+// hand-rolled windowed table and MSM accumulation with no known-answer
+// vectors to check it against -- not a change to make unverified in code
+// whose entire job is rejecting forged proofs. This function does no less
+// EC arithmetic than n calls to ECVRF_verify would. What it does provide:
+// the n independent "does the recomputed challenge match the proof's"
+// checks are folded into one random linear combination mod q, so a correct
+// batch is confirmed (or an incorrect one rejected) with a single big.Int
+// comparison rather than n; on a combined failure it falls back to
+// verifying each proof individually so the caller learns which one is bad:
+// bad is the index of the first item that fails to decode or verify, and -1
+// when no single item is to blame.
+func ECVRF_verify_batch(pk []byte, items []ECVRFBatchItem) (ok bool, bad int, err error) {
+	if len(items) == 0 {
+		return true, -1, nil
+	}
+
+	P := OS2ECP(pk, pk[31]>>7)
+	if P == nil {
+		return false, -1, ErrMalformedInput
+	}
+
+	challenges := make([]*big.Int, len(items))
+	recomputed := make([]*big.Int, len(items))
+	for i, item := range items {
+		r, c, s, err := ECVRF_decode_proof(item.Pi)
+		if err != nil {
+			return false, i, err
+		}
+
+		var u edwards25519.ProjectiveGroupElement
+		edwards25519.GeDoubleScalarMultVartime(&u, c, P, s)
+
+		h := ECVRF_hash_to_curve(item.M, pk)
+		v := GeAdd(GeScalarMult(r, c), GeScalarMult(h, s))
+
+		challenges[i] = F2IP(c)
+		recomputed[i] = ECVRF_hash_points(ECP2OS(g), ECP2OS(h), S2OS(pk), ECP2OS(r), ECP2OSProj(&u), ECP2OS(v))
+	}
+
+	if combinedChallengeCheck(challenges, recomputed) {
+		return true, -1, nil
+	}
+
+	// The combined check failed; fall back to per-proof verification to
+	// identify the first bad one, matching ECVRF_verify's semantics.
+	for i, item := range items {
+		ok, err := ECVRF_verify(pk, item.Pi, item.M)
+		if err != nil {
+			return false, i, err
+		}
+		if !ok {
+			return false, i, nil
+		}
+	}
+	// Every proof verifies individually but the random linear combination
+	// didn't hold; this should not happen, but don't claim success.
+	return false, -1, ErrInternalError
+}
+
+// combinedChallengeCheck folds Σ ρ_i·(recomputed_i - challenges_i) mod q
+// into a single comparison against zero, using independent random 128-bit
+// weights ρ_i. A mismatch in any one item makes the sum nonzero with
+// overwhelming probability.
+func combinedChallengeCheck(challenges, recomputed []*big.Int) bool {
+	sum := new(big.Int)
+	for i := range challenges {
+		rho, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return false
+		}
+		diff := new(big.Int).Sub(recomputed[i], challenges[i])
+		sum.Add(sum, new(big.Int).Mul(rho, diff))
+	}
+	sum.Mod(sum, q)
+	return sum.Sign() == 0
+}
+
 func GeAdd(p, qe *edwards25519.ExtendedGroupElement) *edwards25519.ExtendedGroupElement {
 	var q CachedGroupElement
 	var r edwards25519.CompletedGroupElement